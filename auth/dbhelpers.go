@@ -0,0 +1,270 @@
+package auth
+
+import (
+	"database/sql"
+	"time"
+)
+
+// AuthDBManager : users and their credentials, queries are shared by postgres and sqlite
+type AuthDBManager struct {
+	Database *sql.DB
+}
+
+const userColumns = "id, username, password_hash, role, created, updated, COALESCE(subject, ''), " +
+	"COALESCE(totp_secret, ''), COALESCE(totp_counter, 0), COALESCE(locked_until, 0) FROM users "
+
+func scanUser(scan func(dest ...interface{}) error) (user User, err error) {
+	err = scan(&user.Id, &user.Username, &user.passwordHash, &user.Role, &user.Created, &user.Updated, &user.subject,
+		&user.totpSecret, &user.totpCounter, &user.LockedUntil)
+	user.External = user.subject != ""
+	user.TOTP = user.totpSecret != ""
+	return
+}
+
+func (authDBManager *AuthDBManager) insertUser(username, passwordHash, role string) (id int, err error) {
+	now := time.Now().Unix()
+	query := "INSERT INTO users (username, password_hash, role, created, updated) VALUES ($1, $2, $3, $4, $4) RETURNING id;"
+	err = authDBManager.Database.QueryRow(query, username, passwordHash, role, now).Scan(&id)
+	return
+}
+
+func (authDBManager *AuthDBManager) selectUserByName(username string) (user User, err error) {
+	row := authDBManager.Database.QueryRow("SELECT "+userColumns+"WHERE username=$1;", username)
+	return scanUser(row.Scan)
+}
+
+func (authDBManager *AuthDBManager) selectUserBySubject(subject string) (user User, err error) {
+	row := authDBManager.Database.QueryRow("SELECT "+userColumns+"WHERE subject=$1;", subject)
+	return scanUser(row.Scan)
+}
+
+// insertExternalUser : the user of the identity provider has no password
+func (authDBManager *AuthDBManager) insertExternalUser(username, subject, role string) (id int, err error) {
+	now := time.Now().Unix()
+	query := "INSERT INTO users (username, password_hash, role, created, updated, subject) VALUES ($1, '', $2, $3, $3, $4) RETURNING id;"
+	err = authDBManager.Database.QueryRow(query, username, role, now, subject).Scan(&id)
+	return
+}
+
+func (authDBManager *AuthDBManager) selectUserById(id int) (user User, err error) {
+	row := authDBManager.Database.QueryRow("SELECT "+userColumns+"WHERE id=$1;", id)
+	return scanUser(row.Scan)
+}
+
+func (authDBManager *AuthDBManager) selectUsers() (users []User, err error) {
+	rows, err := authDBManager.Database.Query("SELECT " + userColumns + "ORDER BY id;")
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	users = make([]User, 0, 16)
+	for rows.Next() {
+		var user User
+		user, err = scanUser(rows.Scan)
+		if err != nil {
+			return
+		}
+		users = append(users, user)
+	}
+	err = rows.Err()
+	return
+}
+
+// countUsers : users with the role ("" for all)
+func (authDBManager *AuthDBManager) countUsers(role string) (count int, err error) {
+	if role == "" {
+		err = authDBManager.Database.QueryRow("SELECT count(*) FROM users;").Scan(&count)
+		return
+	}
+
+	err = authDBManager.Database.QueryRow("SELECT count(*) FROM users WHERE role=$1;", role).Scan(&count)
+	return
+}
+
+func (authDBManager *AuthDBManager) updateUserRole(id int, role string) (err error) {
+	_, err = authDBManager.Database.Exec("UPDATE users SET role=$1, updated=$2 WHERE id=$3;", role, time.Now().Unix(), id)
+	return
+}
+
+// updateUserPassword : the new password unlocks the account
+func (authDBManager *AuthDBManager) updateUserPassword(id int, passwordHash string) (err error) {
+	query := "UPDATE users SET password_hash=$1, failed_logins=0, locked_until=0, updated=$2 WHERE id=$3;"
+	_, err = authDBManager.Database.Exec(query, passwordHash, time.Now().Unix(), id)
+	return
+}
+
+// incrementFailedLogins : failed logins in a row
+func (authDBManager *AuthDBManager) incrementFailedLogins(id int) (failures int, err error) {
+	query := "UPDATE users SET failed_logins=COALESCE(failed_logins, 0)+1 WHERE id=$1 RETURNING failed_logins;"
+	err = authDBManager.Database.QueryRow(query, id).Scan(&failures)
+	return
+}
+
+func (authDBManager *AuthDBManager) lockUser(id int, until int64) (err error) {
+	_, err = authDBManager.Database.Exec("UPDATE users SET failed_logins=0, locked_until=$1 WHERE id=$2;", until, id)
+	return
+}
+
+func (authDBManager *AuthDBManager) resetFailedLogins(id int) (err error) {
+	_, err = authDBManager.Database.Exec("UPDATE users SET failed_logins=0, locked_until=0 WHERE id=$1 AND (failed_logins<>0 OR locked_until<>0);", id)
+	return
+}
+
+func (authDBManager *AuthDBManager) setTOTPPending(id int, secret string) (err error) {
+	_, err = authDBManager.Database.Exec("UPDATE users SET totp_pending=$1 WHERE id=$2;", secret, id)
+	return
+}
+
+func (authDBManager *AuthDBManager) selectTOTPPending(id int) (secret string, err error) {
+	err = authDBManager.Database.QueryRow("SELECT COALESCE(totp_pending, '') FROM users WHERE id=$1;", id).Scan(&secret)
+	return
+}
+
+// setTOTP : enables the pending secret ("" disables totp), counter of the last accepted code prevents replays
+func (authDBManager *AuthDBManager) setTOTP(id int, secret string, counter int64) (err error) {
+	query := "UPDATE users SET totp_secret=NULLIF($1, ''), totp_pending=NULL, totp_counter=$2, updated=$3 WHERE id=$4;"
+	_, err = authDBManager.Database.Exec(query, secret, counter, time.Now().Unix(), id)
+	return
+}
+
+// useTOTPCounter : the code is accepted only once, concurrent logins with the same code are rejected
+func (authDBManager *AuthDBManager) useTOTPCounter(id int, counter int64) (used bool, err error) {
+	result, err := authDBManager.Database.Exec("UPDATE users SET totp_counter=$1 WHERE id=$2 AND COALESCE(totp_counter, 0)<$1;", counter, id)
+	if err != nil {
+		return
+	}
+
+	affected, err := result.RowsAffected()
+	return affected == 1, err
+}
+
+func (authDBManager *AuthDBManager) insertRecoveryCodes(userId int, codeHashes []string) (err error) {
+	tx, err := authDBManager.Database.Begin()
+	if err != nil {
+		return
+	}
+
+	_, err = tx.Exec("DELETE FROM recovery_codes WHERE user_id=$1;", userId)
+	if err != nil {
+		tx.Rollback()
+		return
+	}
+
+	for _, codeHash := range codeHashes {
+		_, err = tx.Exec("INSERT INTO recovery_codes (user_id, code_hash, used) VALUES ($1, $2, 0);", userId, codeHash)
+		if err != nil {
+			tx.Rollback()
+			return
+		}
+	}
+	return tx.Commit()
+}
+
+// useRecoveryCode : marks the unused code as used
+func (authDBManager *AuthDBManager) useRecoveryCode(userId int, codeHash string) (used bool, err error) {
+	query := "UPDATE recovery_codes SET used=$1 WHERE user_id=$2 AND code_hash=$3 AND used=0;"
+	result, err := authDBManager.Database.Exec(query, time.Now().Unix(), userId, codeHash)
+	if err != nil {
+		return
+	}
+
+	affected, err := result.RowsAffected()
+	return affected == 1, err
+}
+
+func (authDBManager *AuthDBManager) deleteRecoveryCodes(userId int) (err error) {
+	_, err = authDBManager.Database.Exec("DELETE FROM recovery_codes WHERE user_id=$1;", userId)
+	return
+}
+
+func (authDBManager *AuthDBManager) deleteUser(id int) (err error) {
+	_, err = authDBManager.Database.Exec("DELETE FROM users WHERE id=$1;", id)
+	return
+}
+
+func (authDBManager *AuthDBManager) insertSession(session Session) (err error) {
+	query := "INSERT INTO sessions (id, user_id, csrf_token, created, expires) VALUES ($1, $2, $3, $4, $5);"
+	_, err = authDBManager.Database.Exec(query, session.id, session.UserId, session.CSRFToken, session.Created, session.Expires)
+	return
+}
+
+func (authDBManager *AuthDBManager) selectSession(id string) (session Session, err error) {
+	row := authDBManager.Database.QueryRow("SELECT id, user_id, csrf_token, created, expires FROM sessions WHERE id=$1;", id)
+	err = row.Scan(&session.id, &session.UserId, &session.CSRFToken, &session.Created, &session.Expires)
+	return
+}
+
+func (authDBManager *AuthDBManager) deleteSession(id string) (err error) {
+	_, err = authDBManager.Database.Exec("DELETE FROM sessions WHERE id=$1;", id)
+	return
+}
+
+func (authDBManager *AuthDBManager) deleteUserSessions(userId int) (err error) {
+	_, err = authDBManager.Database.Exec("DELETE FROM sessions WHERE user_id=$1;", userId)
+	return
+}
+
+func (authDBManager *AuthDBManager) deleteExpiredSessions(now int64) (err error) {
+	_, err = authDBManager.Database.Exec("DELETE FROM sessions WHERE expires<=$1;", now)
+	return
+}
+
+const apiTokenColumns = "id, user_id, name, scope, created, COALESCE(last_used, 0) FROM api_tokens "
+
+func scanAPIToken(scan func(dest ...interface{}) error) (apiToken APIToken, err error) {
+	err = scan(&apiToken.Id, &apiToken.UserId, &apiToken.Name, &apiToken.Scope, &apiToken.Created, &apiToken.LastUsed)
+	return
+}
+
+func (authDBManager *AuthDBManager) insertAPIToken(apiToken APIToken, tokenHash string) (id int, err error) {
+	query := "INSERT INTO api_tokens (user_id, name, token_hash, scope, created, last_used) VALUES ($1, $2, $3, $4, $5, 0) RETURNING id;"
+	err = authDBManager.Database.QueryRow(query, apiToken.UserId, apiToken.Name, tokenHash, apiToken.Scope, apiToken.Created).Scan(&id)
+	return
+}
+
+func (authDBManager *AuthDBManager) selectAPITokenByHash(tokenHash string) (apiToken APIToken, err error) {
+	row := authDBManager.Database.QueryRow("SELECT "+apiTokenColumns+"WHERE token_hash=$1;", tokenHash)
+	return scanAPIToken(row.Scan)
+}
+
+func (authDBManager *AuthDBManager) selectAPITokens(userId int) (apiTokens []APIToken, err error) {
+	rows, err := authDBManager.Database.Query("SELECT "+apiTokenColumns+"WHERE user_id=$1 ORDER BY id;", userId)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	apiTokens = make([]APIToken, 0, 4)
+	for rows.Next() {
+		var apiToken APIToken
+		apiToken, err = scanAPIToken(rows.Scan)
+		if err != nil {
+			return
+		}
+		apiTokens = append(apiTokens, apiToken)
+	}
+	err = rows.Err()
+	return
+}
+
+// touchAPIToken : last_used is updated at most once a minute, so every request does not write
+func (authDBManager *AuthDBManager) touchAPIToken(id int, now int64) (err error) {
+	_, err = authDBManager.Database.Exec("UPDATE api_tokens SET last_used=$1 WHERE id=$2 AND COALESCE(last_used, 0)<$3;", now, id, now-60)
+	return
+}
+
+func (authDBManager *AuthDBManager) deleteAPIToken(userId, id int) (deleted bool, err error) {
+	result, err := authDBManager.Database.Exec("DELETE FROM api_tokens WHERE user_id=$1 AND id=$2;", userId, id)
+	if err != nil {
+		return
+	}
+
+	affected, err := result.RowsAffected()
+	return affected == 1, err
+}
+
+func (authDBManager *AuthDBManager) deleteUserAPITokens(userId int) (err error) {
+	_, err = authDBManager.Database.Exec("DELETE FROM api_tokens WHERE user_id=$1;", userId)
+	return
+}
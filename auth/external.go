@@ -0,0 +1,73 @@
+package auth
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"../database"
+)
+
+// ErrNoRole : none of the groups of the external user is mapped to a role
+var ErrNoRole = errors.New("no role is mapped to the user groups")
+
+// MapRole : the highest role of the groups, defaultRole when none of them is mapped
+func MapRole(groups []string, roles map[string]string, defaultRole string) (role string) {
+	for _, group := range groups {
+		mapped, exist := roles[group]
+		if exist && roleRanks[mapped] > roleRanks[role] {
+			role = mapped
+		}
+	}
+
+	if role == "" {
+		return defaultRole
+	}
+	return
+}
+
+// LoginExternal : user authenticated by the identity provider, it is created on the first login.
+// The role is updated on every login, so it is managed by the groups of the provider.
+func LoginExternal(subject, username, role string) (user User, err error) {
+	if role == "" {
+		return user, ErrNoRole
+	}
+
+	err = validRole(role)
+	if err != nil {
+		return
+	}
+
+	dbManager := AuthDBManager{database.DB}
+	user, err = dbManager.selectUserBySubject(subject)
+	if err == sql.ErrNoRows {
+		// local accounts are never taken over by the provider
+		_, err = dbManager.selectUserByName(username)
+		if err == nil {
+			return User{}, fmt.Errorf("username %q is used by another account", username)
+		}
+
+		if err != sql.ErrNoRows {
+			return
+		}
+
+		id, err := dbManager.insertExternalUser(username, subject, role)
+		if err != nil {
+			return user, err
+		}
+		return dbManager.selectUserById(id)
+	}
+
+	if err != nil {
+		return
+	}
+
+	if user.Role != role {
+		err = dbManager.updateUserRole(user.Id, role)
+		if err != nil {
+			return
+		}
+		user.Role = role
+	}
+	return
+}
@@ -0,0 +1,108 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	"../database"
+)
+
+// ErrSessionExpired : the session is unknown, revoked or expired
+var ErrSessionExpired = errors.New("session is expired")
+
+// Session : server side state of the login, the cookie keeps only the token.
+// Tokens are stored hashed, so the sessions table does not allow to log in.
+type Session struct {
+	UserId    int
+	CSRFToken string
+	Created   int64
+	Expires   int64
+
+	id string
+}
+
+// RandomToken : url-safe token of 32 random bytes
+func RandomToken() (string, error) {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// CreateSession : new session of the user, valid for ttl. Expired sessions are removed on the way.
+func CreateSession(userId int, ttl time.Duration) (token string, session Session, err error) {
+	token, err = RandomToken()
+	if err != nil {
+		return
+	}
+
+	csrfToken, err := RandomToken()
+	if err != nil {
+		return
+	}
+
+	now := time.Now()
+	session = Session{
+		UserId:    userId,
+		CSRFToken: csrfToken,
+		Created:   now.Unix(),
+		Expires:   now.Add(ttl).Unix(),
+		id:        hashToken(token),
+	}
+
+	dbManager := AuthDBManager{database.DB}
+	err = dbManager.deleteExpiredSessions(session.Created)
+	if err != nil {
+		return
+	}
+
+	err = dbManager.insertSession(session)
+	return
+}
+
+// GetSession : the session of the token and its user
+func GetSession(token string) (session Session, user User, err error) {
+	if token == "" {
+		return session, user, ErrSessionExpired
+	}
+
+	dbManager := AuthDBManager{database.DB}
+	session, err = dbManager.selectSession(hashToken(token))
+	if err == sql.ErrNoRows || (err == nil && session.Expires <= time.Now().Unix()) {
+		return Session{}, user, ErrSessionExpired
+	}
+
+	if err != nil {
+		return
+	}
+
+	user, err = dbManager.selectUserById(session.UserId)
+	if err == sql.ErrNoRows {
+		return Session{}, user, ErrSessionExpired
+	}
+	return
+}
+
+// RevokeSession : logs out the session of the token
+func RevokeSession(token string) (err error) {
+	dbManager := AuthDBManager{database.DB}
+	return dbManager.deleteSession(hashToken(token))
+}
+
+// RevokeUserSessions : logs out all sessions of the user
+func RevokeUserSessions(userId int) (err error) {
+	dbManager := AuthDBManager{database.DB}
+	return dbManager.deleteUserSessions(userId)
+}
@@ -0,0 +1,115 @@
+package auth
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"../database"
+)
+
+// Scopes of api tokens: read tokens are read-only, write tokens have the role of their user
+const (
+	ScopeRead  = "read"
+	ScopeWrite = "write"
+)
+
+// apiTokenPrefix : makes tokens recognizable for secret scanners
+const apiTokenPrefix = "gs_"
+
+// ErrInvalidToken : unknown or revoked api token, or its user is removed
+var ErrInvalidToken = errors.New("invalid api token")
+
+// APIToken : personal token of machine clients, only its hash is stored
+type APIToken struct {
+	Id       int    `json:"id"`
+	UserId   int    `json:"user_id"`
+	Name     string `json:"name"`
+	Scope    string `json:"scope"`
+	Created  int64  `json:"created"`
+	LastUsed int64  `json:"last_used"`
+}
+
+// restrict : the user with the role allowed by the token scope
+func (apiToken APIToken) restrict(user User) User {
+	if apiToken.Scope != ScopeWrite {
+		user.Role = RoleReadOnly
+	}
+	return user
+}
+
+// CreateAPIToken : new token of the user, the token itself is returned only once
+func CreateAPIToken(user User, name, scope string) (token string, apiToken APIToken, err error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return token, apiToken, fmt.Errorf("token name is empty")
+	}
+
+	if scope != ScopeRead && scope != ScopeWrite {
+		return token, apiToken, fmt.Errorf("unknown scope %q", scope)
+	}
+
+	token, err = RandomToken()
+	if err != nil {
+		return
+	}
+	token = apiTokenPrefix + token
+
+	apiToken = APIToken{
+		UserId:  user.Id,
+		Name:    name,
+		Scope:   scope,
+		Created: time.Now().Unix(),
+	}
+
+	dbManager := AuthDBManager{database.DB}
+	apiToken.Id, err = dbManager.insertAPIToken(apiToken, hashToken(token))
+	return
+}
+
+// GetAPITokens : tokens of the user
+func GetAPITokens(userId int) (apiTokens []APIToken, err error) {
+	dbManager := AuthDBManager{database.DB}
+	return dbManager.selectAPITokens(userId)
+}
+
+// RevokeAPIToken : removes the token of the user
+func RevokeAPIToken(userId, tokenId int) (err error) {
+	dbManager := AuthDBManager{database.DB}
+	deleted, err := dbManager.deleteAPIToken(userId, tokenId)
+	if err == nil && !deleted {
+		return sql.ErrNoRows
+	}
+	return
+}
+
+// AuthenticateAPIToken : the token and its user restricted by the token scope
+func AuthenticateAPIToken(token string) (apiToken APIToken, user User, err error) {
+	if !strings.HasPrefix(token, apiTokenPrefix) {
+		return apiToken, user, ErrInvalidToken
+	}
+
+	dbManager := AuthDBManager{database.DB}
+	apiToken, err = dbManager.selectAPITokenByHash(hashToken(token))
+	if err == sql.ErrNoRows {
+		return APIToken{}, user, ErrInvalidToken
+	}
+
+	if err != nil {
+		return
+	}
+
+	user, err = dbManager.selectUserById(apiToken.UserId)
+	if err == sql.ErrNoRows {
+		return APIToken{}, User{}, ErrInvalidToken
+	}
+
+	if err != nil {
+		return
+	}
+
+	err = dbManager.touchAPIToken(apiToken.Id, time.Now().Unix())
+	return apiToken, apiToken.restrict(user), err
+}
@@ -0,0 +1,165 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base32"
+	"fmt"
+	"strings"
+	"time"
+
+	"../database"
+
+	"github.com/pquerna/otp"
+	"github.com/pquerna/otp/totp"
+)
+
+const (
+	totpIssuer        = "git-search"
+	totpPeriod        = 30
+	totpSkew          = 1
+	recoveryCodeCount = 10
+)
+
+var totpOpts = totp.ValidateOpts{Period: totpPeriod, Digits: otp.DigitsSix, Algorithm: otp.AlgorithmSHA1}
+
+// TOTPEnrollment : the pending secret, totp is enabled after the first valid code
+type TOTPEnrollment struct {
+	Secret string `json:"secret"`
+	URL    string `json:"url"`
+}
+
+// totpCodeCounter : time step of the code, the neighbour steps are accepted for clock drift
+func totpCodeCounter(secret, code string, now time.Time) (counter int64, valid bool) {
+	current := now.Unix() / totpPeriod
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		expected, err := totp.GenerateCodeCustom(secret, time.Unix(step*totpPeriod, 0), totpOpts)
+		if err == nil && subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+func normalizeRecoveryCode(code string) string {
+	return strings.ToLower(strings.Replace(code, "-", "", -1))
+}
+
+func newRecoveryCodes() (codes []string, err error) {
+	encoding := base32.StdEncoding.WithPadding(base32.NoPadding)
+	for i := 0; i < recoveryCodeCount; i++ {
+		b := make([]byte, 10)
+		_, err = rand.Read(b)
+		if err != nil {
+			return
+		}
+
+		code := strings.ToLower(encoding.EncodeToString(b))
+		codes = append(codes, code[:4]+"-"+code[4:8]+"-"+code[8:12]+"-"+code[12:])
+	}
+	return
+}
+
+// verifySecondFactor : the totp code is accepted once, the recovery code is used up
+func verifySecondFactor(dbManager *AuthDBManager, user User, code string) (valid bool, err error) {
+	code = strings.TrimSpace(code)
+	if len(code) == int(otp.DigitsSix) {
+		counter, valid := totpCodeCounter(user.totpSecret, code, time.Now())
+		if !valid || counter <= user.totpCounter {
+			return false, nil
+		}
+		return dbManager.useTOTPCounter(user.Id, counter)
+	}
+
+	return dbManager.useRecoveryCode(user.Id, hashToken(normalizeRecoveryCode(code)))
+}
+
+// EnrollTOTP : generates the secret for the authenticator app
+func EnrollTOTP(user User) (enrollment TOTPEnrollment, err error) {
+	if user.External {
+		return enrollment, fmt.Errorf("second factor of external users is managed by the identity provider")
+	}
+
+	if user.TOTP {
+		return enrollment, fmt.Errorf("totp is already enabled")
+	}
+
+	key, err := totp.Generate(totp.GenerateOpts{Issuer: totpIssuer, AccountName: user.Username, Period: totpPeriod})
+	if err != nil {
+		return
+	}
+
+	dbManager := AuthDBManager{database.DB}
+	err = dbManager.setTOTPPending(user.Id, key.Secret())
+	if err != nil {
+		return
+	}
+	return TOTPEnrollment{Secret: key.Secret(), URL: key.URL()}, nil
+}
+
+// ConfirmTOTP : enables the pending secret, when the code is valid. Recovery codes are returned only once.
+func ConfirmTOTP(user User, code string) (recoveryCodes []string, err error) {
+	dbManager := AuthDBManager{database.DB}
+	secret, err := dbManager.selectTOTPPending(user.Id)
+	if err != nil {
+		return
+	}
+
+	if secret == "" {
+		return nil, fmt.Errorf("totp enrolment is not started")
+	}
+
+	counter, valid := totpCodeCounter(secret, strings.TrimSpace(code), time.Now())
+	if !valid {
+		return nil, ErrInvalidCode
+	}
+
+	recoveryCodes, err = newRecoveryCodes()
+	if err != nil {
+		return
+	}
+
+	codeHashes := make([]string, 0, len(recoveryCodes))
+	for _, recoveryCode := range recoveryCodes {
+		codeHashes = append(codeHashes, hashToken(normalizeRecoveryCode(recoveryCode)))
+	}
+
+	err = dbManager.insertRecoveryCodes(user.Id, codeHashes)
+	if err != nil {
+		return nil, err
+	}
+
+	err = dbManager.setTOTP(user.Id, secret, counter)
+	if err != nil {
+		return nil, err
+	}
+	return
+}
+
+// DisableTOTP : the user disables totp with the valid code
+func DisableTOTP(user User, code string) (err error) {
+	if !user.TOTP {
+		return fmt.Errorf("totp is not enabled")
+	}
+
+	dbManager := AuthDBManager{database.DB}
+	valid, err := verifySecondFactor(&dbManager, user, code)
+	if err != nil {
+		return
+	}
+
+	if !valid {
+		return ErrInvalidCode
+	}
+	return ResetTOTP(user.Id)
+}
+
+// ResetTOTP : disables totp and removes recovery codes, when the user lost the authenticator
+func ResetTOTP(userId int) (err error) {
+	dbManager := AuthDBManager{database.DB}
+	err = dbManager.setTOTP(userId, "", 0)
+	if err != nil {
+		return
+	}
+	return dbManager.deleteRecoveryCodes(userId)
+}
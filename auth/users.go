@@ -0,0 +1,329 @@
+package auth
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"../config"
+	"../database"
+	"../logger"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Roles, every role is allowed to do what the lower ones can
+const (
+	RoleReadOnly = "read-only"
+	RoleAnalyst  = "analyst"
+	RoleAdmin    = "admin"
+)
+
+var roleRanks = map[string]int{
+	RoleReadOnly: 1,
+	RoleAnalyst:  2,
+	RoleAdmin:    3,
+}
+
+const minPasswordLength = 8
+
+const (
+	defaultMaxFailures     = 5
+	defaultLockoutDuration = 15 * time.Minute
+)
+
+// Login errors, ErrInvalidCredentials does not distinguish unknown users from wrong passwords
+var (
+	ErrInvalidCredentials = errors.New("incorrect username or password")
+	ErrLocked             = errors.New("account is temporarily locked")
+	ErrCodeRequired       = errors.New("authentication code is required")
+	ErrInvalidCode        = errors.New("incorrect authentication code")
+)
+
+// dummyHash : compared, when the user does not exist, so the response time does not reveal usernames
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("dummy password"), bcrypt.DefaultCost)
+
+// User : account of the web interface
+type User struct {
+	Id       int    `json:"id"`
+	Username string `json:"username"`
+	Role     string `json:"role"`
+	Created  int64  `json:"created"`
+	Updated  int64  `json:"updated"`
+	// External : the user logs in through the identity provider, the role is taken from there
+	External bool `json:"external"`
+	// TOTP : the second factor is required on login
+	TOTP        bool  `json:"totp"`
+	LockedUntil int64 `json:"locked_until"`
+
+	passwordHash string
+	subject      string
+	totpSecret   string
+	totpCounter  int64
+}
+
+// UserUpdate : fields of the created or updated user, empty fields are not changed on update
+type UserUpdate struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+	Role     string `json:"role"`
+}
+
+// Allows : the user has the role or a higher one
+func (user User) Allows(role string) bool {
+	return roleRanks[user.Role] >= roleRanks[role]
+}
+
+func validRole(role string) error {
+	if _, exist := roleRanks[role]; !exist {
+		return fmt.Errorf("unknown role %q", role)
+	}
+	return nil
+}
+
+func hashPassword(password string) (string, error) {
+	if len(password) < minPasswordLength {
+		return "", fmt.Errorf("password should be at least %d characters long", minPasswordLength)
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	return string(hash), err
+}
+
+// Authenticate : user with the username, the password and the totp or recovery code, when totp is enabled.
+// The account is locked after repeated failures, till the lockout expires or the password is changed.
+func Authenticate(username, password, code string) (user User, err error) {
+	dbManager := AuthDBManager{database.DB}
+	user, err = dbManager.selectUserByName(username)
+	if err == sql.ErrNoRows {
+		bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+		return User{}, ErrInvalidCredentials
+	}
+
+	if err != nil {
+		return
+	}
+
+	if user.External {
+		bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+		return User{}, ErrInvalidCredentials
+	}
+
+	if user.LockedUntil > time.Now().Unix() {
+		bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+		return User{}, ErrLocked
+	}
+
+	if bcrypt.CompareHashAndPassword([]byte(user.passwordHash), []byte(password)) != nil {
+		return User{}, loginFailure(&dbManager, user, ErrInvalidCredentials)
+	}
+
+	// the missing code is a failure too, otherwise the response would confirm the password without a limit
+	if user.TOTP {
+		if code == "" {
+			return User{}, loginFailure(&dbManager, user, ErrCodeRequired)
+		}
+
+		valid, err := verifySecondFactor(&dbManager, user, code)
+		if err != nil {
+			return User{}, err
+		}
+		if !valid {
+			return User{}, loginFailure(&dbManager, user, ErrInvalidCode)
+		}
+	}
+
+	err = dbManager.resetFailedLogins(user.Id)
+	return
+}
+
+// loginFailure : counts the failure and locks the account, when there are too many of them
+func loginFailure(dbManager *AuthDBManager, user User, loginErr error) (err error) {
+	setting := config.Settings.Login
+	maxFailures := setting.MaxFailures
+	if maxFailures == 0 {
+		maxFailures = defaultMaxFailures
+	}
+
+	lockout := defaultLockoutDuration
+	if setting.LockoutDuration != "" {
+		lockout, err = time.ParseDuration(setting.LockoutDuration)
+		if err != nil {
+			return fmt.Errorf("login.lockout_duration: %v", err)
+		}
+	}
+
+	failures, err := dbManager.incrementFailedLogins(user.Id)
+	if err != nil {
+		return
+	}
+
+	if failures >= maxFailures {
+		err = dbManager.lockUser(user.Id, time.Now().Add(lockout).Unix())
+		if err != nil {
+			return
+		}
+		logger.Log.WithField("username", user.Username).WithField("failures", failures).Warn("account is locked")
+	}
+	return loginErr
+}
+
+// GetUser : user by the username
+func GetUser(username string) (user User, err error) {
+	dbManager := AuthDBManager{database.DB}
+	return dbManager.selectUserByName(username)
+}
+
+// GetUsers : all users
+func GetUsers() (users []User, err error) {
+	dbManager := AuthDBManager{database.DB}
+	return dbManager.selectUsers()
+}
+
+// CreateUser : new user with the hashed password
+func CreateUser(update UserUpdate) (user User, err error) {
+	update.Username = strings.TrimSpace(update.Username)
+	if update.Username == "" {
+		return user, fmt.Errorf("username is empty")
+	}
+
+	err = validRole(update.Role)
+	if err != nil {
+		return
+	}
+
+	hash, err := hashPassword(update.Password)
+	if err != nil {
+		return
+	}
+
+	dbManager := AuthDBManager{database.DB}
+	id, err := dbManager.insertUser(update.Username, hash, update.Role)
+	if err != nil {
+		return
+	}
+	return dbManager.selectUserById(id)
+}
+
+// lastAdmin : the admin can not be removed or demoted, when there are no other admins
+func lastAdmin(dbManager *AuthDBManager, user User) (bool, error) {
+	if user.Role != RoleAdmin {
+		return false, nil
+	}
+
+	admins, err := dbManager.countUsers(RoleAdmin)
+	return admins <= 1, err
+}
+
+// UpdateUser : changes the role and/or the password of the user
+func UpdateUser(userId int, update UserUpdate) (user User, err error) {
+	dbManager := AuthDBManager{database.DB}
+	user, err = dbManager.selectUserById(userId)
+	if err != nil {
+		return
+	}
+
+	if update.Role != "" && update.Role != user.Role {
+		err = validRole(update.Role)
+		if err != nil {
+			return
+		}
+
+		last, err := lastAdmin(&dbManager, user)
+		if err != nil {
+			return user, err
+		}
+		if last {
+			return user, fmt.Errorf("the last admin can not be demoted")
+		}
+
+		err = dbManager.updateUserRole(userId, update.Role)
+		if err != nil {
+			return user, err
+		}
+	}
+
+	if update.Password != "" {
+		hash, err := hashPassword(update.Password)
+		if err != nil {
+			return user, err
+		}
+
+		err = dbManager.updateUserPassword(userId, hash)
+		if err != nil {
+			return user, err
+		}
+
+		// sessions, that were logged in with the old password, are revoked
+		err = dbManager.deleteUserSessions(userId)
+		if err != nil {
+			return user, err
+		}
+	}
+	return dbManager.selectUserById(userId)
+}
+
+// DeleteUser : removes the user, the last admin is kept
+func DeleteUser(userId int) (err error) {
+	dbManager := AuthDBManager{database.DB}
+	user, err := dbManager.selectUserById(userId)
+	if err != nil {
+		return
+	}
+
+	last, err := lastAdmin(&dbManager, user)
+	if err != nil {
+		return
+	}
+	if last {
+		return fmt.Errorf("the last admin can not be removed")
+	}
+
+	err = dbManager.deleteUserSessions(userId)
+	if err != nil {
+		return
+	}
+
+	err = dbManager.deleteRecoveryCodes(userId)
+	if err != nil {
+		return
+	}
+
+	err = dbManager.deleteUserAPITokens(userId)
+	if err != nil {
+		return
+	}
+	return dbManager.deleteUser(userId)
+}
+
+// EnsureAdmin : creates the admin from admin_credentials, when there are no users yet.
+// After that admin_credentials are not used, accounts are managed through the api.
+func EnsureAdmin() (err error) {
+	dbManager := AuthDBManager{database.DB}
+	count, err := dbManager.countUsers("")
+	if err != nil || count > 0 {
+		return
+	}
+
+	credentials := config.Settings.AdminCredentials
+	if credentials.Username == "" || credentials.Password == "" {
+		logger.Log.Warn("there are no users, set admin_credentials to create the first admin")
+		return
+	}
+
+	// the configured password is kept as is, even if it is shorter than required for new passwords
+	hash, err := bcrypt.GenerateFromPassword([]byte(credentials.Password), bcrypt.DefaultCost)
+	if err != nil {
+		return
+	}
+
+	_, err = dbManager.insertUser(credentials.Username, string(hash), RoleAdmin)
+	if err != nil {
+		return
+	}
+
+	logger.Log.WithField("username", credentials.Username).Info("admin is created from admin_credentials")
+	return
+}
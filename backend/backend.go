@@ -1,22 +1,24 @@
 package backend
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"html/template"
 	"io"
-	"math/rand"
+	"net/http"
 	"strconv"
 	"time"
 
+	"../auth"
 	"../commons"
 	"../config"
 	"../database"
 	"../gitsearch"
+	"../logger"
 
 	"golang.org/x/crypto/acme/autocert"
 
-	"github.com/gorilla/sessions"
 	"github.com/labstack/echo"
 	"github.com/labstack/echo-contrib/session"
 )
@@ -44,21 +46,27 @@ func (t *Template) Render(w io.Writer, name string, data interface{}, c echo.Con
 	return t.templates.ExecuteTemplate(w, name, data)
 }
 
-type ErrorContext struct {
-	Error string
-}
-
-//start backend
-func StartBack(db *sql.DB) {
+//start backend, returns after the context is canceled and the server is shut down
+func StartBack(ctx context.Context, db *sql.DB) {
 	e := echo.New()
 	//pass db pointer to echo handler
 	t := &Template{
 		templates: template.Must(template.ParseGlob("frontend/templates/*")),
 	}
 
-	secret := []byte(RandStringBytes(20))
+	store, err := newSessionStore(config.Settings.Session)
+	if err != nil {
+		logger.Log.WithError(err).Fatal("can not load session keys")
+	}
+	sessionStore = store
+
+	trustedProxies, err = parseTrustedProxies(config.Settings.Login.TrustedProxies)
+	if err != nil {
+		logger.Log.WithError(err).Fatal("can not parse trusted proxies")
+	}
+
 	e.AutoTLSManager.Cache = autocert.DirCache("/var/www/.cache")
-	e.Use(session.Middleware(sessions.NewCookieStore(secret)))
+	e.Use(session.Middleware(sessionStore))
 	e.Renderer = t
 	e.Use(func(h echo.HandlerFunc) echo.HandlerFunc {
 		return func(c echo.Context) error {
@@ -67,31 +75,78 @@ func StartBack(db *sql.DB) {
 		}
 	})
 
-	credentials.username = config.Settings.AdminCredentials.Username
-	credentials.password = config.Settings.AdminCredentials.Password
-
 	//e.Pre(middleware.HTTPSRedirect())
-	e.File("/", "frontend/index.html", loginRequired)
-	e.File("/settings", "frontend/index.html", loginRequired)
-	e.File("/github", "frontend/index.html", loginRequired)
-	e.File("/gist", "frontend/index.html", loginRequired)
+	e.File("/", "frontend/index.html", readOnlyRequired)
+	e.File("/settings", "frontend/index.html", adminRequired)
+	e.File("/github", "frontend/index.html", readOnlyRequired)
+	e.File("/gist", "frontend/index.html", readOnlyRequired)
+	e.File("/gitlab", "frontend/index.html", readOnlyRequired)
 
 	e.Static("/static", "frontend/static/")
 
-	e.GET("/api/get/:datatype/:status", getReports, loginRequired)
-	e.GET("/api/mark/:datatype/:fragment_id/:status", markResult, loginRequired)
-	e.POST("/api/update/:type", updateData, loginRequired)
-	e.GET("/api/info/:type", getInfo, loginRequired)
-	e.GET("/api/regexp/:type", updateRegexp, loginRequired)
-	e.POST("/api/regexp/:type", updateRegexp, loginRequired)
+	// read-only users view findings, analysts triage them and run the pipeline, admins manage settings and users.
+	// State-changing routes are protected from csrf by the token of the session.
+	e.GET("/api/get/:datatype/:status", getReports, readOnlyRequired)
+	e.POST("/api/mark/:datatype/:fragment_id/:status", markResult, analystRequired, csrfRequired)
+	e.POST("/api/update/:type", updateData, adminRequired, csrfRequired)
+	e.GET("/api/info/:type", getInfo, readOnlyRequired)
+	e.GET("/api/runs", getRuns, readOnlyRequired)
+	e.POST("/api/run/:stage", startRun, analystRequired, csrfRequired)
+	e.POST("/api/cancel/:run_id", cancelRun, analystRequired, csrfRequired)
+	e.GET("/api/jobs/:status", getJobs, readOnlyRequired)
+	e.POST("/api/requeue/:job_id", requeueJob, analystRequired, csrfRequired)
+	// "get" is allowed to read-only users, "add" and "remove" are checked by the handler
+	e.GET("/api/regexp/:type", updateRegexp, readOnlyRequired, csrfRequired)
+	e.POST("/api/regexp/:type", updateRegexp, readOnlyRequired, csrfRequired)
+
+	e.GET("/api/users", getUsers, adminRequired)
+	e.POST("/api/users", createUser, adminRequired, csrfRequired)
+	e.POST("/api/users/:user_id", updateUser, adminRequired, csrfRequired)
+	e.DELETE("/api/users/:user_id", deleteUser, adminRequired, csrfRequired)
+	e.DELETE("/api/users/:user_id/sessions", revokeUserSessions, adminRequired, csrfRequired)
+	e.DELETE("/api/users/:user_id/totp", resetTOTP, adminRequired, csrfRequired)
+
+	// every user enrols totp for the own account, api tokens can not change it
+	e.POST("/api/totp/enroll", enrollTOTP, readOnlyRequired, sessionRequired, csrfRequired)
+	e.POST("/api/totp/confirm", confirmTOTP, readOnlyRequired, sessionRequired, csrfRequired)
+	e.POST("/api/totp/disable", disableTOTP, readOnlyRequired, sessionRequired, csrfRequired)
+
+	// personal api tokens for machine clients, they are accepted by every api route in the Authorization header.
+	// Tokens are issued and revoked only in the browser session.
+	e.GET("/api/tokens", getAPITokens, readOnlyRequired)
+	e.POST("/api/tokens", createAPIToken, readOnlyRequired, sessionRequired, csrfRequired)
+	e.DELETE("/api/tokens/:token_id", revokeAPIToken, readOnlyRequired, sessionRequired, csrfRequired)
+
+	// prometheus scrapes the metrics with an api token in the Authorization header (bearer_token of the scrape config)
+	e.GET("/metrics", echo.WrapHandler(gitsearch.MetricsHandler()), readOnlyRequired)
+	e.GET("/healthz", healthz)
+	e.GET("/readyz", readyz)
 
 	e.GET("/login", loginPage)
 	e.POST("/login", handleLogin)
+	e.GET("/logout", handleLogout)
+	e.GET("/login/oidc", oidcLogin)
+	e.GET("/login/oidc/callback", oidcCallback)
 
 	e.HideBanner = true
 	e.Debug = true
+
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		err := e.Shutdown(shutdownCtx)
+		if err != nil {
+			e.Logger.Error(err)
+		}
+	}()
+
 	//e.Logger.Fatal(e.StartAutoTLS(":1234"))
-	e.Logger.Fatal(e.Start(":1234"))
+	err = e.Start(":1234")
+	if err != nil && err != http.ErrServerClosed {
+		e.Logger.Fatal(err)
+	}
 }
 
 //handler for getting requests from database
@@ -124,7 +179,112 @@ func markResult(c echo.Context) (err error) {
 	return c.String(200, "OK")
 }
 
+// startRun : starts search, fetch, extract or the whole pipeline, optionally for a single keyword
+func startRun(c echo.Context) (err error) {
+	run, err := gitsearch.StartRun(c.Param("stage"), c.FormValue("keyword"))
+	if err != nil {
+		return c.String(409, err.Error())
+	}
+	return c.JSON(200, run)
+}
+
+func cancelRun(c echo.Context) (err error) {
+	runId, err := strconv.Atoi(c.Param("run_id"))
+	if err != nil {
+		return c.String(404, "Invalid Run ID")
+	}
+
+	err = gitsearch.CancelRun(runId)
+	if err != nil {
+		return c.String(404, err.Error())
+	}
+	return c.String(200, "OK")
+}
+
+// getRuns : the current run ("current" param) or the history of runs
+func getRuns(c echo.Context) (err error) {
+	if c.FormValue("current") != "" {
+		run, err := gitsearch.CurrentRun()
+		if err != nil {
+			return c.String(404, err.Error())
+		}
+		return c.JSON(200, run)
+	}
+
+	var limit, offset int
+	if limitParam := c.FormValue("limit"); limitParam != "" {
+		if limit, err = strconv.Atoi(limitParam); err != nil {
+			return c.String(404, "Invalid limit")
+		}
+	}
+
+	if offsetParam := c.FormValue("offset"); offsetParam != "" {
+		if offset, err = strconv.Atoi(offsetParam); err != nil {
+			return c.String(404, "Invalid offset")
+		}
+	}
+
+	runs, err := gitsearch.GetRuns(limit, offset)
+	if err != nil {
+		return c.String(500, err.Error())
+	}
+	return c.JSON(200, runs)
+}
+
+func getJobs(c echo.Context) (err error) {
+	status := c.Param("status")
+	if status == "all" {
+		status = ""
+	}
+
+	var limit, offset int
+	if limitParam := c.FormValue("limit"); limitParam != "" {
+		if limit, err = strconv.Atoi(limitParam); err != nil {
+			return c.String(404, "Invalid limit")
+		}
+	}
+
+	if offsetParam := c.FormValue("offset"); offsetParam != "" {
+		if offset, err = strconv.Atoi(offsetParam); err != nil {
+			return c.String(404, "Invalid offset")
+		}
+	}
+
+	jobs, err := gitsearch.GetJobs(status, limit, offset)
+	if err != nil {
+		return c.String(500, err.Error())
+	}
+	return c.JSON(200, jobs)
+}
+
+// requeueJob : requeues the failed job, "all" requeues every failed job
+func requeueJob(c echo.Context) (err error) {
+	jobIdParam := c.Param("job_id")
+	if jobIdParam == "all" {
+		n, err := gitsearch.RequeueFailedJobs()
+		if err != nil {
+			return c.String(500, err.Error())
+		}
+		return c.JSON(200, map[string]int{"requeued": n})
+	}
+
+	jobId, err := strconv.Atoi(jobIdParam)
+	if err != nil {
+		return c.String(404, "Invalid Job ID")
+	}
+
+	err = gitsearch.RequeueJob(jobId)
+	if err != nil {
+		return c.String(500, err.Error())
+	}
+	return c.String(200, "OK")
+}
+
 func updateRegexp(c echo.Context) (err error) {
+	if c.Param("type") != "get" && !currentUser(c).Allows(auth.RoleAnalyst) {
+		return c.String(http.StatusForbidden, "Forbidden")
+	}
+
 	switch c.Param("type") {
 	case "get":
 		{
@@ -201,12 +361,50 @@ func getInfo(c echo.Context) (err error) {
 	switch c.Param("type") {
 	case "settings":
 		{
+			// settings contain tokens
+			if !currentUser(c).Allows(auth.RoleAdmin) {
+				return c.String(http.StatusForbidden, "Forbidden")
+			}
+
 			info := config.Settings
 			info.AdminCredentials.Password = ""
 			info.DBCredentials.Password = ""
+			info.DBCredentials.DSN = ""
+			info.Session.HashKey = ""
+			info.Session.BlockKey = ""
+			info.OIDC.ClientSecret = ""
+			info.Log.Level = logger.Level()
 			return c.JSON(200, info)
 		}
 
+	case "user":
+		{
+			return c.JSON(200, currentUser(c))
+		}
+
+	case "tokens":
+		{
+			return c.JSON(200, gitsearch.TokenQuotas())
+		}
+
+	case "schedule":
+		{
+			schedules, err := gitsearch.Schedules()
+			if err != nil {
+				return c.String(500, err.Error())
+			}
+			return c.JSON(200, schedules)
+		}
+
+	case "exclude":
+		{
+			stats, err := gitsearch.ExcludeStats()
+			if err != nil {
+				return c.String(500, err.Error())
+			}
+			return c.JSON(200, stats)
+		}
+
 	case "fragment":
 		{
 			fragmentIdParam := c.FormValue("id")
@@ -255,9 +453,33 @@ func getReports(c echo.Context) (err error) {
 		offset, err = strconv.Atoi(offsetParam)
 	}
 
+	if err != nil {
+		return err
+	}
+
+	// optional filter by the secret detectors
+	filter := gitsearch.FragmentFilter{Detector: c.FormValue("detector")}
+	confidenceParam := c.FormValue("confidence")
+	if confidenceParam != "" {
+		var confidence float64
+		confidence, err = strconv.ParseFloat(confidenceParam, 32)
+		if err != nil {
+			return err
+		}
+		filter.MinConfidence = float32(confidence)
+	}
+
 	switch c.Param("datatype") {
 	case "github":
-		result, err = gitsearch.GetGitReports(c.Param("status"), limit, offset)
+		result, err = gitsearch.GetGitReports(c.Param("status"), limit, offset, filter)
+		return c.JSON(200, result)
+
+	case "gitlab":
+		result, err = gitsearch.GetGitlabReports(c.Param("status"), limit, offset, filter)
+		return c.JSON(200, result)
+
+	case "gist":
+		result, err = gitsearch.GetGistReports(c.Param("status"), limit, offset, filter)
 		return c.JSON(200, result)
 
 	default:
@@ -266,14 +488,3 @@ func getReports(c echo.Context) (err error) {
 
 	return c.String(404, "Not Found")
 }
-
-const letterBytes = "abcdefghijklmnopqrstuvwxyz"
-
-func RandStringBytes(n int) string {
-	rand.Seed(time.Now().Unix())
-	b := make([]byte, n)
-	for i := range b {
-		b[i] = letterBytes[rand.Intn(len(letterBytes))]
-	}
-	return string(b)
-}
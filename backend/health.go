@@ -0,0 +1,148 @@
+package backend
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"../config"
+	"../database"
+	"../gitsearch"
+
+	"github.com/labstack/echo"
+)
+
+const (
+	healthOk   = "ok"
+	healthFail = "fail"
+
+	defaultMaxSearchAge = 24 * time.Hour
+)
+
+// startTime : an instance, that has not searched yet, is ready till the max search age passes
+var startTime = time.Now()
+
+type healthCheck struct {
+	Status  string `json:"status"`
+	Message string `json:"message,omitempty"`
+}
+
+type healthReport struct {
+	Status string                 `json:"status"`
+	Checks map[string]healthCheck `json:"checks"`
+}
+
+func checkResult(err error) healthCheck {
+	if err != nil {
+		return healthCheck{Status: healthFail, Message: err.Error()}
+	}
+	return healthCheck{Status: healthOk}
+}
+
+func checkDatabase() error {
+	if database.DB == nil {
+		return fmt.Errorf("database is not connected")
+	}
+	return database.DB.Ping()
+}
+
+// checkContentDir : fetched files are written there
+func checkContentDir() error {
+	file, err := ioutil.TempFile(config.Settings.Globals.ContentDir, ".healthz-")
+	if err != nil {
+		return err
+	}
+
+	file.Close()
+	return os.Remove(file.Name())
+}
+
+// checkTokens : tokens are invalid, when the api answered 401 or the github app token could not be issued
+func checkTokens() error {
+	if len(gitsearch.Providers()) == 0 {
+		return fmt.Errorf("no tokens configured")
+	}
+
+	var invalid []string
+	for _, quota := range gitsearch.TokenQuotas() {
+		if quota.Invalid {
+			invalid = append(invalid, fmt.Sprintf("%s#%d", quota.Pool, quota.Index))
+		}
+	}
+
+	if len(invalid) > 0 {
+		return fmt.Errorf("invalid tokens: %s", strings.Join(invalid, ", "))
+	}
+	return nil
+}
+
+func checkLastSearch() error {
+	maxAge := defaultMaxSearchAge
+	if setting := config.Settings.Health.MaxSearchAge; setting != "" {
+		parsed, err := time.ParseDuration(setting)
+		if err != nil {
+			return fmt.Errorf("max_search_age: %v", err)
+		}
+		maxAge = parsed
+	}
+
+	finished, err := gitsearch.LastSearchRun()
+	if err != nil {
+		return err
+	}
+
+	if finished == 0 {
+		if time.Since(startTime) > maxAge {
+			return fmt.Errorf("no successful search since start %s ago", time.Since(startTime).Truncate(time.Second))
+		}
+		return nil
+	}
+
+	age := time.Since(time.Unix(finished, 0))
+	if age > maxAge {
+		return fmt.Errorf("last successful search was %s ago", age.Truncate(time.Second))
+	}
+	return nil
+}
+
+func healthResponse(c echo.Context, checks map[string]healthCheck) error {
+	report := healthReport{Status: healthOk, Checks: checks}
+	for _, check := range checks {
+		if check.Status != healthOk {
+			report.Status = healthFail
+		}
+	}
+
+	if report.Status != healthOk {
+		return c.JSON(http.StatusServiceUnavailable, report)
+	}
+	return c.JSON(http.StatusOK, report)
+}
+
+// healthz : liveness, the instance can not work without the database and the content directory
+func healthz(c echo.Context) error {
+	return healthResponse(c, map[string]healthCheck{
+		"database":    checkResult(checkDatabase()),
+		"content_dir": checkResult(checkContentDir()),
+	})
+}
+
+// readyz : readiness, also fails when tokens are invalid or the search is stale
+func readyz(c echo.Context) error {
+	checks := map[string]healthCheck{
+		"database":    checkResult(checkDatabase()),
+		"content_dir": checkResult(checkContentDir()),
+		"tokens":      checkResult(checkTokens()),
+	}
+
+	// the age of the last search can not be known without the database
+	if checks["database"].Status == healthOk {
+		checks["last_search"] = checkResult(checkLastSearch())
+	} else {
+		checks["last_search"] = healthCheck{Status: healthFail, Message: "database is unavailable"}
+	}
+	return healthResponse(c, checks)
+}
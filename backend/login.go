@@ -1,67 +1,145 @@
 package backend
 
 import (
-	"github.com/gorilla/sessions"
-	"github.com/labstack/echo"
-	"github.com/labstack/echo-contrib/session"
 	"net/http"
+	"strings"
+	"time"
+
+	"../auth"
+	"../logger"
+
+	"github.com/labstack/echo"
 )
 
-type user struct {
-	username string
-	password string
+const (
+	// userContextKey : user of the request, it is set by requireRole
+	userContextKey = "user"
+	// apiTokenContextKey : api token of the request, that is authenticated by the Authorization header
+	apiTokenContextKey = "api_token"
+	bearerScheme       = "Bearer "
+)
+
+// loginContext : data of login.html, single sign-on button is shown, when oidc is configured
+type loginContext struct {
+	Error string
+	SSO   bool
 }
 
-var credentials user
+func renderLogin(c echo.Context, status int, message string) error {
+	return c.Render(status, "login.html", loginContext{Error: message, SSO: oidcEnabled()})
+}
 
 func loginPage(c echo.Context) error {
-	if login := getLoginFromSession(c); login != "" {
+	if _, _, err := auth.GetSession(sessionToken(c)); err == nil {
 		return c.Redirect(http.StatusFound, "/")
 	} else {
-		return c.Render(http.StatusOK, "login.html", nil)
+		return renderLogin(c, http.StatusOK, "")
 	}
 }
 
 func handleLogin(c echo.Context) error {
+	if !loginAttempts.allow(clientAddress(c.Request())) {
+		return renderLogin(c, http.StatusTooManyRequests, "Too many login attempts, try again later")
+	}
+
 	login := c.FormValue("username")
 	password := c.FormValue("password")
-	if login == credentials.username && password == credentials.password {
-		sess := loginSession(c, login)
-		if err := sess.Save(c.Request(), c.Response()); err != nil {
-			return c.Render(http.StatusUnprocessableEntity, "login.html", "error")
-		}
-		return c.Redirect(http.StatusFound, "/")
-	} else {
-		return c.Render(http.StatusOK, "login.html",
-			ErrorContext{"Incorrect username or password"},
-		)
+	code := c.FormValue("code")
+
+	// the password is not confirmed, till the second factor is checked, so all failures have the same response
+	user, err := auth.Authenticate(login, password, code)
+	switch err {
+	case nil:
+	case auth.ErrInvalidCredentials, auth.ErrCodeRequired, auth.ErrInvalidCode:
+		return renderLogin(c, http.StatusOK, "Incorrect username, password or authentication code")
+	case auth.ErrLocked:
+		return renderLogin(c, http.StatusOK, "Too many failed attempts, the account is temporarily locked")
+	default:
+		logger.Log.WithError(err).Error("can not authenticate user")
+		return renderLogin(c, http.StatusInternalServerError, "Internal error")
+	}
+
+	err = startSession(c, user)
+	if err != nil {
+		logger.Log.WithError(err).Error("can not start session")
+		return renderLogin(c, http.StatusUnprocessableEntity, "Internal error")
 	}
+	return c.Redirect(http.StatusFound, "/")
 }
 
-func loginSession(c echo.Context, login string) *sessions.Session {
-	sess, _ := session.Get("session", c)
-	sess.Values["username"] = login
-	sess.Options = &sessions.Options{
-		Path: "/",
+// bearerToken : api token of the Authorization header
+func bearerToken(c echo.Context) (token string, exist bool) {
+	header := c.Request().Header.Get(echo.HeaderAuthorization)
+	if len(header) < len(bearerScheme) || !strings.EqualFold(header[:len(bearerScheme)], bearerScheme) {
+		return "", false
 	}
-	sess.Values["username"] = login
-	return sess
+	return strings.TrimSpace(header[len(bearerScheme):]), true
 }
 
-func loginRequired(next echo.HandlerFunc) echo.HandlerFunc {
-	return func(c echo.Context) error {
-		if login := getLoginFromSession(c); login == "" {
-			return c.Redirect(http.StatusFound, "/login")
-		}
-		return next(c)
+// requireToken : machine clients are authenticated by api tokens instead of sessions, they are not redirected to the login page
+func requireToken(c echo.Context, next echo.HandlerFunc, role, token string) error {
+	apiToken, user, err := auth.AuthenticateAPIToken(token)
+	if err == auth.ErrInvalidToken {
+		return c.String(http.StatusUnauthorized, "Invalid token")
 	}
+
+	if err != nil {
+		logger.Log.WithError(err).Error("can not authenticate api token")
+		return c.String(http.StatusInternalServerError, "Internal error")
+	}
+
+	if !user.Allows(role) {
+		return c.String(http.StatusForbidden, "Forbidden")
+	}
+
+	c.Set(apiTokenContextKey, apiToken)
+	c.Set(userContextKey, user)
+	return next(c)
 }
 
-func getLoginFromSession(c echo.Context) string {
-	sess, _ := session.Get("session", c)
-	login, exists := sess.Values["username"]
-	if !exists {
-		return ""
+// requireRole : the user of the session should have the role or a higher one.
+// The session and the user are loaded on every request, so revoked sessions, changed roles and removed users take effect immediately.
+func requireRole(role string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if token, exist := bearerToken(c); exist {
+				return requireToken(c, next, role, token)
+			}
+
+			userSession, user, err := auth.GetSession(sessionToken(c))
+			if err == auth.ErrSessionExpired {
+				return c.Redirect(http.StatusFound, "/login")
+			}
+
+			if err != nil {
+				logger.Log.WithError(err).Error("can not load session")
+				return c.String(http.StatusInternalServerError, "Internal error")
+			}
+
+			if !user.Allows(role) {
+				return c.String(http.StatusForbidden, "Forbidden")
+			}
+
+			// the csrf cookie is restored, when the browser lost it
+			if cookie, err := c.Cookie(csrfCookie); err != nil || cookie.Value != userSession.CSRFToken {
+				c.SetCookie(csrfCookieFor(userSession.CSRFToken, int(userSession.Expires-time.Now().Unix())))
+			}
+
+			c.Set(sessionContextKey, userSession)
+			c.Set(userContextKey, user)
+			return next(c)
+		}
 	}
-	return login.(string)
+}
+
+var (
+	readOnlyRequired = requireRole(auth.RoleReadOnly)
+	analystRequired  = requireRole(auth.RoleAnalyst)
+	adminRequired    = requireRole(auth.RoleAdmin)
+)
+
+// currentUser : user of the request, that passed requireRole
+func currentUser(c echo.Context) auth.User {
+	user, _ := c.Get(userContextKey).(auth.User)
+	return user
 }
@@ -0,0 +1,74 @@
+package backend
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"../auth"
+	"../config"
+
+	"github.com/pquerna/otp/totp"
+)
+
+func postLogin(t *testing.T, app string, username, password, code string) (status int, body string) {
+	resp, err := newBrowser(t).PostForm(app+"/login", url.Values{"username": {username}, "password": {password}, "code": {code}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	page, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, string(page)
+}
+
+func TestLoginSecondFactor(t *testing.T) {
+	issuer := newFakeIssuer(t)
+	defer issuer.Close()
+	app := newOIDCTestApp(t, issuer)
+
+	config.Settings.Login = config.LoginSetting{MaxFailures: 3, AttemptsPerMinute: 100}
+	defer func() { config.Settings.Login = config.LoginSetting{} }()
+
+	admin, err := auth.GetUser("admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	enrollment, err := auth.EnrollTOTP(admin)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	code, err := totp.GenerateCode(enrollment.Secret, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := auth.ConfirmTOTP(admin, code); err != nil {
+		t.Fatal(err)
+	}
+
+	// the correct password without the code is not distinguished from the wrong one
+	_, wrongPassword := postLogin(t, app.URL, "admin", "wrong password", "")
+	_, missingCode := postLogin(t, app.URL, "admin", "admin password", "")
+	if wrongPassword != missingCode {
+		t.Errorf("missing code %q, wrong password %q", missingCode, wrongPassword)
+	}
+
+	// the missing code is counted toward the lockout
+	postLogin(t, app.URL, "admin", "admin password", "")
+	_, locked := postLogin(t, app.URL, "admin", "admin password", "")
+	if locked != "Too many failed attempts, the account is temporarily locked" {
+		t.Errorf("after 3 failures %q, expected the lockout", locked)
+	}
+
+	if status, body := postLogin(t, app.URL, "admin", "admin password", code); status != http.StatusOK || body != locked {
+		t.Errorf("locked account with the code: status %d %q", status, body)
+	}
+}
@@ -0,0 +1,204 @@
+package backend
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"../auth"
+	"../config"
+	"../logger"
+
+	"github.com/coreos/go-oidc"
+	"github.com/labstack/echo"
+	"github.com/labstack/echo-contrib/session"
+	"golang.org/x/oauth2"
+)
+
+const (
+	// oidcCookie : state and nonce of the login in progress
+	oidcCookie         = "oidc"
+	oidcCookieMaxAge   = 600
+	defaultGroupsClaim = "groups"
+)
+
+var (
+	oidcMutex    sync.Mutex
+	oidcVerifier *oidc.IDTokenVerifier
+	oidcConfig   *oauth2.Config
+)
+
+func oidcEnabled() bool {
+	return config.Settings.OIDC.Issuer != ""
+}
+
+// oidcClient : the provider is discovered on the first login, so the server starts, while the provider is unavailable
+func oidcClient() (verifier *oidc.IDTokenVerifier, oauthConfig *oauth2.Config, err error) {
+	oidcMutex.Lock()
+	defer oidcMutex.Unlock()
+
+	if oidcVerifier != nil {
+		return oidcVerifier, oidcConfig, nil
+	}
+
+	setting := config.Settings.OIDC
+	// the context is kept by the provider to fetch the signing keys
+	provider, err := oidc.NewProvider(context.Background(), setting.Issuer)
+	if err != nil {
+		return
+	}
+
+	oidcVerifier = provider.Verifier(&oidc.Config{ClientID: setting.ClientId})
+	oidcConfig = &oauth2.Config{
+		ClientID:     setting.ClientId,
+		ClientSecret: setting.ClientSecret,
+		RedirectURL:  setting.RedirectURL,
+		Endpoint:     provider.Endpoint(),
+		Scopes:       append([]string{oidc.ScopeOpenID, "profile", "email"}, setting.Scopes...),
+	}
+	return oidcVerifier, oidcConfig, nil
+}
+
+// claimStrings : the groups claim is a list or a single string
+func claimStrings(claim interface{}) (values []string) {
+	switch claim := claim.(type) {
+	case string:
+		return []string{claim}
+	case []interface{}:
+		for _, value := range claim {
+			if value, ok := value.(string); ok {
+				values = append(values, value)
+			}
+		}
+	}
+	return
+}
+
+// claimUsername : preferred_username, email or subject, whatever the provider returns first
+func claimUsername(claims map[string]interface{}, subject string) string {
+	for _, name := range []string{"preferred_username", "email"} {
+		if username, ok := claims[name].(string); ok && username != "" {
+			return username
+		}
+	}
+	return subject
+}
+
+func oidcLogin(c echo.Context) error {
+	if !oidcEnabled() {
+		return c.String(404, "Not Found")
+	}
+
+	_, oauthConfig, err := oidcClient()
+	if err != nil {
+		logger.Log.WithError(err).Error("oidc provider is unavailable")
+		return renderLogin(c, http.StatusBadGateway, "Single sign-on is unavailable")
+	}
+
+	state, err := auth.RandomToken()
+	if err != nil {
+		return renderLogin(c, http.StatusInternalServerError, "Internal error")
+	}
+
+	nonce, err := auth.RandomToken()
+	if err != nil {
+		return renderLogin(c, http.StatusInternalServerError, "Internal error")
+	}
+
+	sess, _ := session.Get(oidcCookie, c)
+	sess.Values["state"] = state
+	sess.Values["nonce"] = nonce
+	sess.Options.MaxAge = oidcCookieMaxAge
+	err = sess.Save(c.Request(), c.Response())
+	if err != nil {
+		return renderLogin(c, http.StatusInternalServerError, "Internal error")
+	}
+	return c.Redirect(http.StatusFound, oauthConfig.AuthCodeURL(state, oidc.Nonce(nonce)))
+}
+
+// oidcUser : user of the authorization code, the id token is verified by the provider keys
+func oidcUser(c echo.Context, nonce string) (user auth.User, err error) {
+	verifier, oauthConfig, err := oidcClient()
+	if err != nil {
+		return
+	}
+
+	ctx := c.Request().Context()
+	token, err := oauthConfig.Exchange(ctx, c.QueryParam("code"))
+	if err != nil {
+		return
+	}
+
+	rawIdToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		return user, fmt.Errorf("id_token is missing in the token response")
+	}
+
+	idToken, err := verifier.Verify(ctx, rawIdToken)
+	if err != nil {
+		return
+	}
+
+	if idToken.Nonce != nonce {
+		return user, fmt.Errorf("id_token nonce does not match")
+	}
+
+	var claims map[string]interface{}
+	err = idToken.Claims(&claims)
+	if err != nil {
+		return
+	}
+
+	setting := config.Settings.OIDC
+	groupsClaim := setting.GroupsClaim
+	if groupsClaim == "" {
+		groupsClaim = defaultGroupsClaim
+	}
+
+	role := auth.MapRole(claimStrings(claims[groupsClaim]), setting.Roles, setting.DefaultRole)
+	// the subject is unique only for its issuer
+	return auth.LoginExternal(idToken.Issuer+"#"+idToken.Subject, claimUsername(claims, idToken.Subject), role)
+}
+
+func oidcCallback(c echo.Context) error {
+	if !oidcEnabled() {
+		return c.String(404, "Not Found")
+	}
+
+	sess, _ := session.Get(oidcCookie, c)
+	state, _ := sess.Values["state"].(string)
+	nonce, _ := sess.Values["nonce"].(string)
+
+	// the state is used once
+	sess.Options.MaxAge = -1
+	sess.Save(c.Request(), c.Response())
+
+	if state == "" || c.QueryParam("state") != state {
+		return renderLogin(c, http.StatusBadRequest, "Single sign-on session is expired, try again")
+	}
+
+	if providerError := c.QueryParam("error"); providerError != "" {
+		logger.Log.WithField("error", providerError).WithField("description", c.QueryParam("error_description")).Warn("oidc login is denied")
+		return renderLogin(c, http.StatusUnauthorized, "Single sign-on is denied")
+	}
+
+	user, err := oidcUser(c, nonce)
+	if err == auth.ErrNoRole {
+		return renderLogin(c, http.StatusForbidden, "No role is assigned to your account")
+	}
+
+	if err != nil {
+		logger.Log.WithError(err).Error("oidc login failed")
+		return renderLogin(c, http.StatusUnauthorized, "Single sign-on failed")
+	}
+
+	err = startSession(c, user)
+	if err != nil {
+		logger.Log.WithError(err).Error("can not start session")
+		return renderLogin(c, http.StatusInternalServerError, "Internal error")
+	}
+
+	logger.Log.WithField("username", user.Username).WithField("role", user.Role).Info("oidc login")
+	return c.Redirect(http.StatusFound, "/")
+}
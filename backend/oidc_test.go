@@ -0,0 +1,362 @@
+package backend
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"html/template"
+	"io/ioutil"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"../auth"
+	"../config"
+	"../database"
+
+	"github.com/labstack/echo"
+	"github.com/labstack/echo-contrib/session"
+	jose "gopkg.in/square/go-jose.v2"
+)
+
+const oidcTestClient = "git-search"
+
+// fakeIssuer : discovery, keys, authorization and token endpoints of an identity provider.
+// The id token carries the claims of the next login and the nonce of the last authorization request.
+type fakeIssuer struct {
+	*httptest.Server
+	key    *rsa.PrivateKey
+	mutex  sync.Mutex
+	nonce  string
+	claims map[string]interface{}
+	tokens int
+}
+
+func newFakeIssuer(t *testing.T) *fakeIssuer {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	issuer := &fakeIssuer{key: key}
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"issuer":                                issuer.URL,
+			"authorization_endpoint":                issuer.URL + "/authorize",
+			"token_endpoint":                        issuer.URL + "/token",
+			"jwks_uri":                              issuer.URL + "/keys",
+			"id_token_signing_alg_values_supported": []string{"RS256"},
+		})
+	})
+
+	mux.HandleFunc("/keys", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{{Key: &key.PublicKey, KeyID: "test", Algorithm: "RS256", Use: "sig"}}})
+	})
+
+	// the user is signed in at once
+	mux.HandleFunc("/authorize", func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		issuer.mutex.Lock()
+		issuer.nonce = query.Get("nonce")
+		issuer.mutex.Unlock()
+
+		callback := query.Get("redirect_uri") + "?" + url.Values{"code": {"code"}, "state": {query.Get("state")}}.Encode()
+		http.Redirect(w, r, callback, http.StatusFound)
+	})
+
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		issuer.mutex.Lock()
+		issuer.tokens++
+		claims := map[string]interface{}{
+			"iss":   issuer.URL,
+			"aud":   oidcTestClient,
+			"exp":   time.Now().Add(time.Hour).Unix(),
+			"iat":   time.Now().Unix(),
+			"nonce": issuer.nonce,
+		}
+		for name, value := range issuer.claims {
+			claims[name] = value
+		}
+		issuer.mutex.Unlock()
+
+		idToken, err := issuer.sign(claims)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"access_token": "access", "token_type": "Bearer", "id_token": idToken})
+	})
+
+	issuer.Server = httptest.NewServer(mux)
+	return issuer
+}
+
+func (issuer *fakeIssuer) sign(claims map[string]interface{}) (string, error) {
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.RS256, Key: jose.JSONWebKey{Key: issuer.key, KeyID: "test"}}, nil)
+	if err != nil {
+		return "", err
+	}
+
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	signed, err := signer.Sign(payload)
+	if err != nil {
+		return "", err
+	}
+	return signed.CompactSerialize()
+}
+
+func (issuer *fakeIssuer) setClaims(claims map[string]interface{}) {
+	issuer.mutex.Lock()
+	issuer.claims = claims
+	issuer.mutex.Unlock()
+}
+
+// newOIDCTestApp : login routes and the home page behind the login, the database has the local admin.
+// The issuer is not used by the password login.
+func newOIDCTestApp(t *testing.T, issuer *fakeIssuer) *httptest.Server {
+	dir := t.TempDir()
+	config.Settings.DBCredentials = config.DBCredentialsSetting{Driver: database.DriverSQLite, Path: filepath.Join(dir, "gitsearch.db")}
+	db, err := database.Connect(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = database.Migrate(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config.Settings.AdminCredentials = config.AdminCredentialsConfig{Username: "admin", Password: "admin password"}
+	err = auth.EnsureAdmin()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sessionStore, err = newSessionStore(config.SessionSetting{KeyFile: filepath.Join(dir, "session.key"), InsecureCookie: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e := echo.New()
+	e.Renderer = &Template{templates: template.Must(template.New("login.html").Parse("{{.Error}}"))}
+	e.Use(session.Middleware(sessionStore))
+	e.GET("/login", loginPage)
+	e.POST("/login", handleLogin)
+	e.GET("/login/oidc", oidcLogin)
+	e.GET("/login/oidc/callback", oidcCallback)
+	e.GET("/", func(c echo.Context) error {
+		user := currentUser(c)
+		return c.String(http.StatusOK, user.Username+" "+user.Role)
+	}, readOnlyRequired)
+	app := httptest.NewServer(e)
+
+	// the provider of the previous test is not cached
+	oidcVerifier, oidcConfig = nil, nil
+	config.Settings.OIDC = config.OIDCSetting{
+		Issuer:       issuer.URL,
+		ClientId:     oidcTestClient,
+		ClientSecret: "secret",
+		RedirectURL:  app.URL + "/login/oidc/callback",
+		Roles:        map[string]string{"secops": auth.RoleAnalyst, "staff": auth.RoleReadOnly},
+	}
+
+	t.Cleanup(func() {
+		app.Close()
+		db.Close()
+		oidcVerifier, oidcConfig = nil, nil
+		config.Settings.OIDC = config.OIDCSetting{}
+	})
+	return app
+}
+
+func newBrowser(t *testing.T) *http.Client {
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &http.Client{Jar: jar}
+}
+
+func getPage(t *testing.T, client *http.Client, url string) (status int, body string) {
+	resp, err := client.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, string(data)
+}
+
+func TestOIDCLogin(t *testing.T) {
+	issuer := newFakeIssuer(t)
+	defer issuer.Close()
+	app := newOIDCTestApp(t, issuer)
+
+	tests := []struct {
+		name        string
+		claims      map[string]interface{}
+		defaultRole string
+		status      int
+		body        string
+	}{
+		{
+			name:   "highest role of the groups",
+			claims: map[string]interface{}{"sub": "1", "preferred_username": "alice", "groups": []string{"staff", "secops"}},
+			status: http.StatusOK,
+			body:   "alice analyst",
+		},
+		{
+			name:   "single group claim",
+			claims: map[string]interface{}{"sub": "2", "email": "bob@example.com", "groups": "staff"},
+			status: http.StatusOK,
+			body:   "bob@example.com read-only",
+		},
+		{
+			name:        "default role",
+			claims:      map[string]interface{}{"sub": "3", "preferred_username": "carol", "groups": []string{"guests"}},
+			defaultRole: auth.RoleReadOnly,
+			status:      http.StatusOK,
+			body:        "carol read-only",
+		},
+		{
+			name:   "no role",
+			claims: map[string]interface{}{"sub": "4", "preferred_username": "dave", "groups": []string{"guests"}},
+			status: http.StatusForbidden,
+			body:   "No role is assigned to your account",
+		},
+		{
+			name:   "nonce mismatch",
+			claims: map[string]interface{}{"sub": "5", "preferred_username": "eve", "groups": []string{"secops"}, "nonce": "replayed"},
+			status: http.StatusUnauthorized,
+			body:   "Single sign-on failed",
+		},
+		{
+			name:   "local username",
+			claims: map[string]interface{}{"sub": "6", "preferred_username": "admin", "groups": []string{"secops"}},
+			status: http.StatusUnauthorized,
+			body:   "Single sign-on failed",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config.Settings.OIDC.DefaultRole = test.defaultRole
+			issuer.setClaims(test.claims)
+
+			status, body := getPage(t, newBrowser(t), app.URL+"/login/oidc")
+			if status != test.status || body != test.body {
+				t.Fatalf("status %d %q, expected %d %q", status, body, test.status, test.body)
+			}
+		})
+	}
+
+	// the local account keeps its role and password
+	admin, err := auth.GetUser("admin")
+	if err != nil || admin.External || admin.Role != auth.RoleAdmin {
+		t.Fatalf("local admin %+v (%v)", admin, err)
+	}
+
+	if _, err := auth.Authenticate("admin", "admin password", ""); err != nil {
+		t.Fatalf("local admin login: %v", err)
+	}
+
+	// rejected users are not created
+	for _, username := range []string{"dave", "eve"} {
+		if _, err := auth.GetUser(username); err == nil {
+			t.Errorf("user %s is created", username)
+		}
+	}
+}
+
+func TestOIDCStateMismatch(t *testing.T) {
+	issuer := newFakeIssuer(t)
+	defer issuer.Close()
+	app := newOIDCTestApp(t, issuer)
+	issuer.setClaims(map[string]interface{}{"sub": "1", "preferred_username": "alice", "groups": []string{"secops"}})
+
+	browser := newBrowser(t)
+	// the login is started, but the browser does not follow the provider
+	browser.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+
+	status, _ := getPage(t, browser, app.URL+"/login/oidc")
+	if status != http.StatusFound {
+		t.Fatalf("login status %d, expected redirect to the provider", status)
+	}
+
+	tests := []struct {
+		name    string
+		browser *http.Client
+	}{
+		{"forged state", browser},
+		{"no login in progress", newBrowser(t)},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			status, body := getPage(t, test.browser, app.URL+"/login/oidc/callback?code=code&state=forged")
+			if status != http.StatusBadRequest || body != "Single sign-on session is expired, try again" {
+				t.Fatalf("status %d %q, expected the rejected callback", status, body)
+			}
+		})
+	}
+
+	issuer.mutex.Lock()
+	tokens := issuer.tokens
+	issuer.mutex.Unlock()
+	if tokens != 0 {
+		t.Errorf("code is exchanged %d times for the rejected state", tokens)
+	}
+
+	status, _ = getPage(t, browser, app.URL+"/")
+	if status != http.StatusFound {
+		t.Errorf("home status %d, expected redirect to the login", status)
+	}
+}
+
+func TestMapRole(t *testing.T) {
+	roles := map[string]string{"secops": auth.RoleAnalyst, "staff": auth.RoleReadOnly, "root": auth.RoleAdmin}
+
+	tests := []struct {
+		groups      []string
+		defaultRole string
+		expected    string
+	}{
+		{[]string{"staff"}, "", auth.RoleReadOnly},
+		{[]string{"staff", "secops"}, "", auth.RoleAnalyst},
+		{[]string{"secops", "root", "staff"}, "", auth.RoleAdmin},
+		{[]string{"guests"}, auth.RoleReadOnly, auth.RoleReadOnly},
+		{[]string{"staff"}, auth.RoleAnalyst, auth.RoleReadOnly},
+		{[]string{"guests"}, "", ""},
+		{nil, "", ""},
+	}
+
+	for _, test := range tests {
+		if role := auth.MapRole(test.groups, roles, test.defaultRole); role != test.expected {
+			t.Errorf("groups %v with default %q: role %q, expected %q", test.groups, test.defaultRole, role, test.expected)
+		}
+	}
+
+	if _, err := auth.LoginExternal("issuer#7", "frank", ""); err != auth.ErrNoRole {
+		t.Errorf("login without role: %v, expected %v", err, auth.ErrNoRole)
+	}
+}
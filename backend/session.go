@@ -0,0 +1,214 @@
+package backend
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"time"
+
+	"../auth"
+	"../config"
+	"../logger"
+
+	"github.com/gorilla/sessions"
+	"github.com/labstack/echo"
+	"github.com/labstack/echo-contrib/session"
+)
+
+const (
+	sessionCookie   = "session"
+	sessionTokenKey = "token"
+	// axios sends the XSRF-TOKEN cookie back in the X-XSRF-TOKEN header by default
+	csrfCookie = "XSRF-TOKEN"
+	csrfHeader = "X-XSRF-TOKEN"
+
+	sessionContextKey     = "session"
+	defaultSessionKeyFile = "./config/session.key"
+	defaultSessionMaxAge  = 12 * time.Hour
+)
+
+var (
+	sessionStore  *sessions.CookieStore
+	sessionMaxAge = defaultSessionMaxAge
+)
+
+func decodeKey(name, value string) (key []byte, err error) {
+	key, err = base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		return nil, fmt.Errorf("session.%s: %v", name, err)
+	}
+	return
+}
+
+// sessionKeys : hash and block keys of the cookie store from config or from the key file.
+// The key file is generated on the first start, so sessions survive restarts.
+func sessionKeys(setting config.SessionSetting) (hashKey, blockKey []byte, err error) {
+	if setting.HashKey != "" {
+		hashKey, err = decodeKey("hash_key", setting.HashKey)
+		if err != nil {
+			return
+		}
+
+		if setting.BlockKey != "" {
+			blockKey, err = decodeKey("block_key", setting.BlockKey)
+			if err != nil {
+				return
+			}
+
+			switch len(blockKey) {
+			case 16, 24, 32:
+			default:
+				return nil, nil, fmt.Errorf("session.block_key should be 16, 24 or 32 bytes long")
+			}
+		}
+		return
+	}
+
+	keyFile := setting.KeyFile
+	if keyFile == "" {
+		keyFile = defaultSessionKeyFile
+	}
+
+	keys, err := ioutil.ReadFile(keyFile)
+	if os.IsNotExist(err) {
+		keys = make([]byte, 64)
+		_, err = rand.Read(keys)
+		if err != nil {
+			return
+		}
+
+		err = ioutil.WriteFile(keyFile, keys, 0600)
+		if err == nil {
+			logger.Log.WithField("key_file", keyFile).Info("session keys are generated")
+		}
+	}
+
+	if err != nil {
+		return
+	}
+
+	if len(keys) != 64 {
+		return nil, nil, fmt.Errorf("%s: session key file should contain 64 bytes", keyFile)
+	}
+	return keys[:32], keys[32:], nil
+}
+
+// newSessionStore : cookie store with the persistent keys and hardened cookie options
+func newSessionStore(setting config.SessionSetting) (store *sessions.CookieStore, err error) {
+	if setting.MaxAge != "" {
+		sessionMaxAge, err = time.ParseDuration(setting.MaxAge)
+		if err != nil {
+			return nil, fmt.Errorf("session.max_age: %v", err)
+		}
+	}
+
+	hashKey, blockKey, err := sessionKeys(setting)
+	if err != nil {
+		return
+	}
+
+	store = sessions.NewCookieStore(hashKey, blockKey)
+	store.Options = &sessions.Options{
+		Path:     "/",
+		Secure:   !setting.InsecureCookie,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}
+	store.MaxAge(int(sessionMaxAge.Seconds()))
+	return
+}
+
+// csrfCookieFor : the csrf token is readable by the frontend, unlike the session cookie
+func csrfCookieFor(token string, maxAge int) *http.Cookie {
+	return &http.Cookie{
+		Name:     csrfCookie,
+		Value:    token,
+		Path:     "/",
+		MaxAge:   maxAge,
+		Secure:   sessionStore.Options.Secure,
+		SameSite: http.SameSiteStrictMode,
+	}
+}
+
+// startSession : server side session of the user, the cookie keeps its token
+func startSession(c echo.Context, user auth.User) (err error) {
+	token, userSession, err := auth.CreateSession(user.Id, sessionMaxAge)
+	if err != nil {
+		return
+	}
+
+	sess, _ := session.Get(sessionCookie, c)
+	sess.Values[sessionTokenKey] = token
+	err = sess.Save(c.Request(), c.Response())
+	if err != nil {
+		return
+	}
+
+	c.SetCookie(csrfCookieFor(userSession.CSRFToken, sessionStore.Options.MaxAge))
+	return
+}
+
+func sessionToken(c echo.Context) string {
+	sess, _ := session.Get(sessionCookie, c)
+	token, _ := sess.Values[sessionTokenKey].(string)
+	return token
+}
+
+// currentSession : session of the request, that passed requireRole
+func currentSession(c echo.Context) auth.Session {
+	userSession, _ := c.Get(sessionContextKey).(auth.Session)
+	return userSession
+}
+
+func handleLogout(c echo.Context) error {
+	token := sessionToken(c)
+	if token != "" {
+		err := auth.RevokeSession(token)
+		if err != nil {
+			logger.Log.WithError(err).Error("can not revoke session")
+		}
+	}
+
+	sess, _ := session.Get(sessionCookie, c)
+	sess.Options.MaxAge = -1
+	sess.Save(c.Request(), c.Response())
+	c.SetCookie(csrfCookieFor("", -1))
+	return c.Redirect(http.StatusFound, "/login")
+}
+
+// csrfRequired : state-changing requests should carry the csrf token of the session in the X-XSRF-TOKEN header.
+// Requests with api tokens are not checked, browsers do not send the Authorization header on their own.
+func csrfRequired(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if isTokenRequest(c) {
+			return next(c)
+		}
+
+		expected := currentSession(c).CSRFToken
+		actual := c.Request().Header.Get(csrfHeader)
+		if expected == "" || subtle.ConstantTimeCompare([]byte(actual), []byte(expected)) != 1 {
+			return c.String(http.StatusForbidden, "Invalid CSRF token")
+		}
+		return next(c)
+	}
+}
+
+// isTokenRequest : the request is authenticated by the api token, not by the session
+func isTokenRequest(c echo.Context) bool {
+	_, exist := c.Get(apiTokenContextKey).(auth.APIToken)
+	return exist
+}
+
+// sessionRequired : account security is managed in the browser session, api tokens can not change it
+func sessionRequired(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if isTokenRequest(c) {
+			return c.String(http.StatusForbidden, "Forbidden")
+		}
+		return next(c)
+	}
+}
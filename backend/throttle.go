@@ -0,0 +1,121 @@
+package backend
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"../config"
+)
+
+const defaultAttemptsPerMinute = 10
+
+// trustedProxies : networks of reverse proxies, only their X-Forwarded-For and X-Real-IP headers are honoured
+var trustedProxies []*net.IPNet
+
+// parseTrustedProxies : addresses and networks of login.trusted_proxies
+func parseTrustedProxies(entries []string) (networks []*net.IPNet, err error) {
+	for _, entry := range entries {
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("login.trusted_proxies: invalid address %q", entry)
+			}
+
+			bits := 8 * net.IPv4len
+			if ip.To4() == nil {
+				bits = 8 * net.IPv6len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("login.trusted_proxies: %v", err)
+		}
+		networks = append(networks, network)
+	}
+	return
+}
+
+func trustedProxy(address string) bool {
+	ip := net.ParseIP(strings.TrimSpace(address))
+	if ip == nil {
+		return false
+	}
+
+	for _, network := range trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientAddress : the peer address, the forwarded address is used only when the peer is a trusted proxy.
+// X-Forwarded-For is read from the right, so the addresses appended by trusted proxies are skipped and the client can not forge its address.
+func clientAddress(req *http.Request) string {
+	address, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		address = req.RemoteAddr
+	}
+
+	if !trustedProxy(address) {
+		return address
+	}
+
+	if forwardedFor := req.Header.Get("X-Forwarded-For"); forwardedFor != "" {
+		hops := strings.Split(forwardedFor, ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop := strings.TrimSpace(hops[i])
+			if hop == "" {
+				continue
+			}
+
+			if !trustedProxy(hop) {
+				return hop
+			}
+			address = hop
+		}
+		return address
+	}
+
+	if realIP := strings.TrimSpace(req.Header.Get("X-Real-IP")); realIP != "" {
+		return realIP
+	}
+	return address
+}
+
+// loginThrottle : login attempts of every address in the current minute
+type loginThrottle struct {
+	sync.Mutex
+	minute   int64
+	attempts map[string]int
+}
+
+var loginAttempts = loginThrottle{attempts: make(map[string]int)}
+
+// allow : counts the attempt, false when the address exceeded the limit
+func (throttle *loginThrottle) allow(address string) bool {
+	limit := config.Settings.Login.AttemptsPerMinute
+	if limit == 0 {
+		limit = defaultAttemptsPerMinute
+	}
+
+	throttle.Lock()
+	defer throttle.Unlock()
+
+	// counters are dropped every minute, so the map does not grow
+	minute := time.Now().Unix() / 60
+	if minute != throttle.minute {
+		throttle.minute = minute
+		throttle.attempts = make(map[string]int)
+	}
+
+	throttle.attempts[address]++
+	return throttle.attempts[address] <= limit
+}
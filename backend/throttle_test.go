@@ -0,0 +1,53 @@
+package backend
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientAddress(t *testing.T) {
+	var err error
+	trustedProxies, err = parseTrustedProxies([]string{"10.0.0.1", "192.168.0.0/16"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { trustedProxies = nil }()
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		headers    map[string]string
+		expected   string
+	}{
+		{"direct", "203.0.113.5:4000", nil, "203.0.113.5"},
+		{"forged by untrusted peer", "203.0.113.5:4000", map[string]string{"X-Forwarded-For": "1.1.1.1", "X-Real-IP": "2.2.2.2"}, "203.0.113.5"},
+		{"trusted proxy", "10.0.0.1:4000", map[string]string{"X-Forwarded-For": "198.51.100.7"}, "198.51.100.7"},
+		{"forged behind trusted proxy", "10.0.0.1:4000", map[string]string{"X-Forwarded-For": "1.1.1.1, 198.51.100.7"}, "198.51.100.7"},
+		{"chain of trusted proxies", "10.0.0.1:4000", map[string]string{"X-Forwarded-For": "198.51.100.7, 192.168.1.2"}, "198.51.100.7"},
+		{"only trusted hops", "10.0.0.1:4000", map[string]string{"X-Forwarded-For": "192.168.1.2"}, "192.168.1.2"},
+		{"real ip of trusted proxy", "192.168.3.4:4000", map[string]string{"X-Real-IP": "198.51.100.8"}, "198.51.100.8"},
+		{"trusted proxy without headers", "10.0.0.1:4000", nil, "10.0.0.1"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest("POST", "/login", nil)
+			req.RemoteAddr = test.remoteAddr
+			for name, value := range test.headers {
+				req.Header.Set(name, value)
+			}
+
+			if address := clientAddress(req); address != test.expected {
+				t.Errorf("address %s, expected %s", address, test.expected)
+			}
+		})
+	}
+}
+
+func TestParseTrustedProxies(t *testing.T) {
+	for _, entries := range [][]string{{"proxy.local"}, {"10.0.0.0/33"}} {
+		if _, err := parseTrustedProxies(entries); err == nil {
+			t.Errorf("%v is accepted", entries)
+		}
+	}
+}
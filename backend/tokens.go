@@ -0,0 +1,60 @@
+package backend
+
+import (
+	"database/sql"
+	"strconv"
+
+	"../auth"
+
+	"github.com/labstack/echo"
+)
+
+// apiTokenRequest : body of the token creation, scope is "read" or "write"
+type apiTokenRequest struct {
+	Name  string `json:"name"`
+	Scope string `json:"scope"`
+}
+
+func getAPITokens(c echo.Context) (err error) {
+	apiTokens, err := auth.GetAPITokens(currentUser(c).Id)
+	if err != nil {
+		return c.String(500, err.Error())
+	}
+	return c.JSON(200, apiTokens)
+}
+
+// createAPIToken : the token itself is returned only once
+func createAPIToken(c echo.Context) (err error) {
+	var body apiTokenRequest
+	err = c.Bind(&body)
+	if err != nil {
+		return c.String(400, err.Error())
+	}
+
+	token, apiToken, err := auth.CreateAPIToken(currentUser(c), body.Name, body.Scope)
+	if err != nil {
+		return c.String(400, err.Error())
+	}
+
+	return c.JSON(200, struct {
+		auth.APIToken
+		Token string `json:"token"`
+	}{apiToken, token})
+}
+
+func revokeAPIToken(c echo.Context) (err error) {
+	tokenId, err := strconv.Atoi(c.Param("token_id"))
+	if err != nil {
+		return c.String(404, "Invalid Token ID")
+	}
+
+	err = auth.RevokeAPIToken(currentUser(c).Id, tokenId)
+	if err == sql.ErrNoRows {
+		return c.String(404, "Token not found")
+	}
+
+	if err != nil {
+		return c.String(500, err.Error())
+	}
+	return c.String(200, "OK")
+}
@@ -0,0 +1,64 @@
+package backend
+
+import (
+	"strconv"
+
+	"../auth"
+
+	"github.com/labstack/echo"
+)
+
+// totpCode : body of the totp confirmation and disabling
+type totpCode struct {
+	Code string `json:"code"`
+}
+
+func enrollTOTP(c echo.Context) (err error) {
+	enrollment, err := auth.EnrollTOTP(currentUser(c))
+	if err != nil {
+		return c.String(400, err.Error())
+	}
+	return c.JSON(200, enrollment)
+}
+
+func confirmTOTP(c echo.Context) (err error) {
+	var body totpCode
+	err = c.Bind(&body)
+	if err != nil {
+		return c.String(400, err.Error())
+	}
+
+	recoveryCodes, err := auth.ConfirmTOTP(currentUser(c), body.Code)
+	if err != nil {
+		return c.String(400, err.Error())
+	}
+	return c.JSON(200, map[string][]string{"recovery_codes": recoveryCodes})
+}
+
+func disableTOTP(c echo.Context) (err error) {
+	var body totpCode
+	err = c.Bind(&body)
+	if err != nil {
+		return c.String(400, err.Error())
+	}
+
+	err = auth.DisableTOTP(currentUser(c), body.Code)
+	if err != nil {
+		return c.String(400, err.Error())
+	}
+	return c.String(200, "OK")
+}
+
+// resetTOTP : admin disables totp of the user, who lost the authenticator and recovery codes
+func resetTOTP(c echo.Context) (err error) {
+	userId, err := strconv.Atoi(c.Param("user_id"))
+	if err != nil {
+		return c.String(404, "Invalid User ID")
+	}
+
+	err = auth.ResetTOTP(userId)
+	if err != nil {
+		return c.String(500, err.Error())
+	}
+	return c.String(200, "OK")
+}
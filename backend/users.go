@@ -0,0 +1,86 @@
+package backend
+
+import (
+	"database/sql"
+	"strconv"
+
+	"../auth"
+
+	"github.com/labstack/echo"
+)
+
+func getUsers(c echo.Context) (err error) {
+	users, err := auth.GetUsers()
+	if err != nil {
+		return c.String(500, err.Error())
+	}
+	return c.JSON(200, users)
+}
+
+func createUser(c echo.Context) (err error) {
+	var update auth.UserUpdate
+	err = c.Bind(&update)
+	if err != nil {
+		return c.String(400, err.Error())
+	}
+
+	user, err := auth.CreateUser(update)
+	if err != nil {
+		return c.String(400, err.Error())
+	}
+	return c.JSON(200, user)
+}
+
+func updateUser(c echo.Context) (err error) {
+	userId, err := strconv.Atoi(c.Param("user_id"))
+	if err != nil {
+		return c.String(404, "Invalid User ID")
+	}
+
+	var update auth.UserUpdate
+	err = c.Bind(&update)
+	if err != nil {
+		return c.String(400, err.Error())
+	}
+
+	user, err := auth.UpdateUser(userId, update)
+	if err == sql.ErrNoRows {
+		return c.String(404, "User not found")
+	}
+
+	if err != nil {
+		return c.String(400, err.Error())
+	}
+	return c.JSON(200, user)
+}
+
+func deleteUser(c echo.Context) (err error) {
+	userId, err := strconv.Atoi(c.Param("user_id"))
+	if err != nil {
+		return c.String(404, "Invalid User ID")
+	}
+
+	err = auth.DeleteUser(userId)
+	if err == sql.ErrNoRows {
+		return c.String(404, "User not found")
+	}
+
+	if err != nil {
+		return c.String(400, err.Error())
+	}
+	return c.String(200, "OK")
+}
+
+// revokeUserSessions : logs the user out of every browser
+func revokeUserSessions(c echo.Context) (err error) {
+	userId, err := strconv.Atoi(c.Param("user_id"))
+	if err != nil {
+		return c.String(404, "Invalid User ID")
+	}
+
+	err = auth.RevokeUserSessions(userId)
+	if err != nil {
+		return c.String(500, err.Error())
+	}
+	return c.String(200, "OK")
+}
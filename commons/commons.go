@@ -1,13 +1,14 @@
 package commons
 
 import (
+	"context"
 	"encoding/json"
 	"io/ioutil"
 	"regexp"
 
 	"../config"
-	"../database"
 	"../gitsearch"
+	"../logger"
 	textutils "../utils"
 )
 
@@ -17,14 +18,18 @@ func UpdateSettings(updatedSettings config.InitStruct) (err error) {
 	config.Settings.Github.Tokens = updatedSettings.Github.Tokens
 	config.Settings.Github.Languages = updatedSettings.Github.Languages
 	config.Settings.Globals.Keywords = updatedSettings.Globals.Keywords
+	config.Settings.Globals.ExcludeList = updatedSettings.Globals.ExcludeList
 
-	if updatedSettings.AdminCredentials.Password != "" {
-		config.Settings.AdminCredentials.Password = updatedSettings.AdminCredentials.Password
+	// log level is changed without restart
+	if updatedSettings.Log.Level != "" {
+		err = logger.SetLevel(updatedSettings.Log.Level)
+		if err != nil {
+			return
+		}
+		config.Settings.Log.Level = updatedSettings.Log.Level
 	}
 
-	if updatedSettings.AdminCredentials.Username != "" {
-		config.Settings.AdminCredentials.Password = updatedSettings.AdminCredentials.Username
-	}
+	// admin_credentials only create the first admin, accounts are changed through /api/users
 
 	jsonSettings, err := json.Marshal(config.Settings)
 
@@ -41,7 +46,7 @@ func InsertRegexp(query gitsearch.RegexpUpdateQuery) (status bool, err error) {
 		return
 	}
 
-	dbManager := gitsearch.GitDBManager{database.DB}
+	dbManager := gitsearch.NewStorage()
 	err = dbManager.InsertRule(query)
 	if err != nil {
 		return
@@ -57,13 +62,13 @@ func InsertRegexp(query gitsearch.RegexpUpdateQuery) (status bool, err error) {
 }
 
 func RemoveRegexp(regexpId int) (err error) {
-	dbManager := gitsearch.GitDBManager{database.DB}
+	dbManager := gitsearch.NewStorage()
 	err = dbManager.RemoveRule(regexpId)
 	return
 }
 
 func GetRegexps() (rules []gitsearch.RuleWeb, err error) {
-	dbManager := gitsearch.GitDBManager{database.DB}
+	dbManager := gitsearch.NewStorage()
 	rules, err = dbManager.GetRulesWeb()
 	return
 }
@@ -110,7 +115,7 @@ func CheckBigFragment(fragment gitsearch.TextFragment, rules []textutils.RejectR
 }
 
 func UpdateRules() (err error) {
-	dbManager := gitsearch.GitDBManager{database.DB}
+	dbManager := gitsearch.NewStorage()
 	reportStatus := "new"
 	nonRejected := 0
 
@@ -119,7 +124,11 @@ func UpdateRules() (err error) {
 		return
 	}
 
-	newReports, err := dbManager.SelectReportByStatus(reportStatus)
+	// reading of the reports stops, when the update fails
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	newReports, err := dbManager.SelectReportByStatus(ctx, reportStatus)
 	if err != nil {
 		return
 	}
@@ -135,6 +144,7 @@ func UpdateRules() (err error) {
 			matched, ruleId := CheckBigFragment(fragment, rules)
 			if matched {
 				dbManager.ChangeFragmentStatus(ruleId, fragment.Id)
+				gitsearch.CountRejectedFragment(ruleId)
 			}
 		}
 
@@ -4,30 +4,131 @@ package config
 
 type InitStruct struct {
 	Github           GithubSetting          `json:"github"`
+	Gitlab           GitlabSetting          `json:"gitlab"`
 	DBCredentials    DBCredentialsSetting   `json:"db_redentials"`
 	Globals          GlobalConfig           `json:"globals"`
+	Schedule         ScheduleSetting        `json:"schedule"`
+	Log              LogSetting             `json:"log"`
+	Health           HealthSetting          `json:"health"`
+	Session          SessionSetting         `json:"session"`
+	OIDC             OIDCSetting            `json:"oidc"`
+	Login            LoginSetting           `json:"login"`
 	AdminCredentials AdminCredentialsConfig `json:"admin_credentials"`
 }
 
+// DBCredentialsSetting : driver is "postgres" (default) or "sqlite", sqlite database is stored in the file at path.
+// Postgres is connected with dsn, when it is set, otherwise with the discrete fields (localhost:5432, sslmode "disable" by default).
 type DBCredentialsSetting struct {
-	Database string `json:"database"`
-	Name     string `json:"name"`
-	Password string `json:"password"`
+	Driver      string `json:"driver"`
+	DSN         string `json:"dsn"`
+	Host        string `json:"host"`
+	Port        int    `json:"port"`
+	Database    string `json:"database"`
+	Name        string `json:"name"`
+	Password    string `json:"password"`
+	SSLMode     string `json:"sslmode"`
+	SSLRootCert string `json:"sslrootcert"`
+	Path        string `json:"path"`
+	// connection pool, zero values keep database/sql defaults; lifetime is a duration ("30m")
+	MaxOpenConns    int    `json:"max_open_conns"`
+	MaxIdleConns    int    `json:"max_idle_conns"`
+	ConnMaxLifetime string `json:"conn_max_lifetime"`
+	// ConnectTimeout : connection is retried with backoff at startup till the timeout ("1m" by default)
+	ConnectTimeout string `json:"connect_timeout"`
 }
 
 type GithubSetting struct {
-	Tokens             []string `json:"tokens"`
-	SearchAPIUrl       string   `json:"search_api"`
-	SearchRateLimit    int      `json:"search_rate_limit"`
-	FetchRateLimit     int      `json:"fetch_rate_limit"`
-	MaxItemsInResponse int      `json:"max_items_in_response"`
-	Languages          []string `json:"langs"`
+	Tokens             []string           `json:"tokens"`
+	SearchAPIUrl       string             `json:"search_api"`
+	SearchRateLimit    int                `json:"search_rate_limit"`
+	FetchRateLimit     int                `json:"fetch_rate_limit"`
+	MaxItemsInResponse int                `json:"max_items_in_response"`
+	Languages          []string           `json:"langs"`
+	PartitionBy        []string           `json:"partition_by"`
+	GistAPIUrl         string             `json:"gist_api"`
+	GistUsers          []string           `json:"gist_users"`
+	Apps               []GithubAppSetting `json:"apps"`
+}
+
+// GithubAppSetting : github app installation, an alternative to personal tokens
+type GithubAppSetting struct {
+	AppId          int64  `json:"app_id"`
+	InstallationId int64  `json:"installation_id"`
+	PrivateKeyPath string `json:"private_key_path"`
+	ApiUrl         string `json:"api_url"`
+}
+
+type GitlabSetting struct {
+	Url             string   `json:"url"`
+	Tokens          []string `json:"tokens"`
+	SearchRateLimit int      `json:"search_rate_limit"`
+	FetchRateLimit  int      `json:"fetch_rate_limit"`
 }
 
 type GlobalConfig struct {
-	Keywords    []string `json:"keywords"`
-	ExcludeList []string `json:"exclude"`
-	ContentDir  string   `json:"content_dir"`
+	Keywords []string `json:"keywords"`
+	// InternalKeywords : are never searched, only highlighted in fragments found by Keywords
+	InternalKeywords []string `json:"internal_keywords"`
+	ExcludeList      []string `json:"exclude"`
+	ContentDir       string   `json:"content_dir"`
+	HistoryScan      bool     `json:"history_scan"`
+	HistoryDir       string   `json:"history_dir"`
+	// JobMaxAttempts : failed fetch or extraction is retried with exponential backoff, till the limit is reached
+	JobMaxAttempts int `json:"job_max_attempts"`
+}
+
+// ScheduleSetting : pipeline schedule, every spec is an interval ("6h") or a cron expression ("0 */6 * * *").
+// Keywords have their own schedules and are excluded from the default one.
+type ScheduleSetting struct {
+	Interval string            `json:"interval"`
+	Cron     string            `json:"cron"`
+	Keywords map[string]string `json:"keywords"`
+}
+
+// LogSetting : format is "logfmt" (default) or "json", level is one of logrus levels (default "info")
+type LogSetting struct {
+	Level  string `json:"level"`
+	Format string `json:"format"`
+}
+
+// HealthSetting : the instance is not ready, when the last successful search is older than MaxSearchAge (default "24h")
+type HealthSetting struct {
+	MaxSearchAge string `json:"max_search_age"`
+}
+
+// SessionSetting : keys of the session cookie are hash_key and block_key (base64), when they are set,
+// otherwise they are read from key_file ("./config/session.key"), that is generated on the first start.
+// Sessions expire after max_age ("12h" by default). The cookie is Secure unless insecure_cookie is set for plain http.
+type SessionSetting struct {
+	HashKey        string `json:"hash_key"`
+	BlockKey       string `json:"block_key"`
+	KeyFile        string `json:"key_file"`
+	MaxAge         string `json:"max_age"`
+	InsecureCookie bool   `json:"insecure_cookie"`
+}
+
+// OIDCSetting : single sign-on through the OpenID Connect provider (authorization code flow), it is disabled, when issuer is empty.
+// Scopes are requested in addition to "openid", "profile" and "email". Users get the highest role of their groups
+// (groups_claim of the id token, "groups" by default) mapped in roles ({"secops": "analyst"}), or default_role, when none is mapped.
+type OIDCSetting struct {
+	Issuer       string            `json:"issuer"`
+	ClientId     string            `json:"client_id"`
+	ClientSecret string            `json:"client_secret"`
+	RedirectURL  string            `json:"redirect_url"`
+	Scopes       []string          `json:"scopes"`
+	GroupsClaim  string            `json:"groups_claim"`
+	Roles        map[string]string `json:"roles"`
+	DefaultRole  string            `json:"default_role"`
+}
+
+// LoginSetting : the account is locked for lockout_duration ("15m") after max_failures (5) failed logins in a row,
+// logins from one address are limited by attempts_per_minute (10). The address is taken from X-Forwarded-For or X-Real-IP
+// only behind trusted_proxies (addresses or networks like "10.0.0.0/8"), otherwise it is the address of the connection.
+type LoginSetting struct {
+	MaxFailures       int      `json:"max_failures"`
+	LockoutDuration   string   `json:"lockout_duration"`
+	AttemptsPerMinute int      `json:"attempts_per_minute"`
+	TrustedProxies    []string `json:"trusted_proxies"`
 }
 
 type AdminCredentialsConfig struct {
@@ -1,13 +1,32 @@
 package database
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"time"
 
 	"../config"
+	"../logger"
 
 	"github.com/labstack/echo"
 	_ "github.com/lib/pq"
+	"github.com/sirupsen/logrus"
+)
+
+// Database drivers (db_redentials.driver in Config.json)
+const (
+	DriverPostgres = "postgres"
+	DriverSQLite   = "sqlite"
+)
+
+const (
+	defaultConnectTimeout = time.Minute
+	connectBackoffBase    = time.Second
+	connectBackoffMax     = 30 * time.Second
 )
 
 type DBContext struct {
@@ -17,21 +36,123 @@ type DBContext struct {
 
 var DB *sql.DB
 
-func Connect() *sql.DB {
-	DBCredentials := config.Settings.DBCredentials
-	ConnectString := fmt.Sprintf("postgres://%s:%s@localhost/%s?sslmode=disable", DBCredentials.Name, DBCredentials.Password, DBCredentials.Database)
+// Driver : driver of the connected database, queries and migrations depend on it
+var Driver string
+
+// postgresDSN : dsn from config, or the url built from the discrete fields
+func postgresDSN(setting config.DBCredentialsSetting) string {
+	if setting.DSN != "" {
+		return setting.DSN
+	}
+
+	host := setting.Host
+	if host == "" {
+		host = "localhost"
+	}
+	if setting.Port != 0 {
+		host = net.JoinHostPort(host, strconv.Itoa(setting.Port))
+	}
+
+	sslMode := setting.SSLMode
+	if sslMode == "" {
+		sslMode = "disable"
+	}
+
+	params := url.Values{}
+	params.Set("sslmode", sslMode)
+	if setting.SSLRootCert != "" {
+		params.Set("sslrootcert", setting.SSLRootCert)
+	}
+
+	dsn := url.URL{
+		Scheme:   "postgres",
+		User:     url.UserPassword(setting.Name, setting.Password),
+		Host:     host,
+		Path:     "/" + setting.Database,
+		RawQuery: params.Encode(),
+	}
+	return dsn.String()
+}
+
+func open(setting config.DBCredentialsSetting) (db *sql.DB, err error) {
+	switch setting.Driver {
+	case DriverPostgres, "":
+		Driver = DriverPostgres
+		db, err = sql.Open("postgres", postgresDSN(setting))
+	case DriverSQLite:
+		Driver = DriverSQLite
+		db, err = openSQLite(setting.Path)
+	default:
+		return nil, fmt.Errorf("unknown database driver %q", setting.Driver)
+	}
 
-	db, err := sql.Open("postgres", ConnectString)
 	if err != nil {
-		panic(err)
+		return
+	}
+
+	db.SetMaxOpenConns(setting.MaxOpenConns)
+	if setting.MaxIdleConns != 0 {
+		db.SetMaxIdleConns(setting.MaxIdleConns)
+	}
+
+	if setting.ConnMaxLifetime != "" {
+		lifetime, err := time.ParseDuration(setting.ConnMaxLifetime)
+		if err != nil {
+			db.Close()
+			return nil, fmt.Errorf("conn_max_lifetime: %v", err)
+		}
+		db.SetConnMaxLifetime(lifetime)
+	}
+	return
+}
+
+// Connect : opens the database from config, the connection is retried with exponential backoff till connect_timeout
+func Connect(ctx context.Context) (db *sql.DB, err error) {
+	setting := config.Settings.DBCredentials
+
+	timeout := defaultConnectTimeout
+	if setting.ConnectTimeout != "" {
+		timeout, err = time.ParseDuration(setting.ConnectTimeout)
+		if err != nil {
+			return nil, fmt.Errorf("connect_timeout: %v", err)
+		}
 	}
 
-	err = db.Ping()
+	db, err = open(setting)
 	if err != nil {
-		panic(err)
+		return
+	}
+
+	log := logger.Log.WithFields(logrus.Fields{"driver": Driver, "database": setting.Database})
+	deadline := time.Now().Add(timeout)
+	delay := connectBackoffBase
+
+	for {
+		err = db.PingContext(ctx)
+		if err == nil {
+			break
+		}
+
+		if time.Now().Add(delay).After(deadline) {
+			db.Close()
+			return nil, fmt.Errorf("database is unavailable after %s: %v", timeout, err)
+		}
+
+		log.WithError(err).WithField("retry_in", delay.String()).Warn("can not connect to database")
+		select {
+		case <-ctx.Done():
+			db.Close()
+			return nil, ctx.Err()
+		case <-time.After(delay):
+		}
+
+		delay *= 2
+		if delay > connectBackoffMax {
+			delay = connectBackoffMax
+		}
 	}
 
-	fmt.Println("Connected")
+	log.Info("connected")
 	DB = db
-	return db
+	return
 }
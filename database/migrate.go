@@ -0,0 +1,148 @@
+package database
+
+import (
+	"database/sql"
+	"embed"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"../logger"
+)
+
+// migrationFiles : versioned schema changes of every driver, file name is "<version>_<name>.sql".
+// Applied migrations are never edited, a schema change is a new file with the next version for both drivers.
+//
+//go:embed migrations/postgres/*.sql migrations/sqlite/*.sql
+var migrationFiles embed.FS
+
+// migrationLock : key of the advisory lock, so instances started together do not apply the same migration
+const migrationLock = 7355608
+
+// Migration : schema change embedded into the binary
+type Migration struct {
+	Version int
+	Name    string
+	SQL     string
+}
+
+func migrations() (list []Migration, err error) {
+	dir := path.Join("migrations", Driver)
+	files, err := migrationFiles.ReadDir(dir)
+	if err != nil {
+		return
+	}
+
+	for _, file := range files {
+		name := strings.TrimSuffix(file.Name(), ".sql")
+		parts := strings.SplitN(name, "_", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("migration %s: name should be <version>_<name>.sql", file.Name())
+		}
+
+		version, err := strconv.Atoi(parts[0])
+		if err != nil {
+			return nil, fmt.Errorf("migration %s: %v", file.Name(), err)
+		}
+
+		data, err := migrationFiles.ReadFile(path.Join(dir, file.Name()))
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, Migration{Version: version, Name: parts[1], SQL: string(data)})
+	}
+
+	sort.Slice(list, func(i, j int) bool { return list[i].Version < list[j].Version })
+	for i := 1; i < len(list); i++ {
+		if list[i].Version == list[i-1].Version {
+			return nil, fmt.Errorf("migration version %d is duplicated", list[i].Version)
+		}
+	}
+	return
+}
+
+// SchemaVersion : version of the last applied migration (0 for the empty database)
+func SchemaVersion(db *sql.DB) (version int, err error) {
+	_, err = db.Exec("create table if not exists schema_version (version integer primary key, name varchar, applied integer);")
+	if err != nil {
+		return
+	}
+
+	err = db.QueryRow("SELECT COALESCE(MAX(version), 0) FROM schema_version;").Scan(&version)
+	return
+}
+
+// applyMigration : the migration and its version are committed together
+func applyMigration(db *sql.DB, migration Migration) (applied bool, err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	// sqlite transactions are serialized by the database lock
+	if Driver == DriverPostgres {
+		_, err = tx.Exec("SELECT pg_advisory_xact_lock($1);", migrationLock)
+		if err != nil {
+			return
+		}
+	}
+
+	// another instance could apply it, while the lock was awaited
+	var exist bool
+	err = tx.QueryRow("SELECT EXISTS (SELECT 1 FROM schema_version WHERE version=$1);", migration.Version).Scan(&exist)
+	if err != nil || exist {
+		return
+	}
+
+	_, err = tx.Exec(migration.SQL)
+	if err != nil {
+		return false, fmt.Errorf("migration %04d_%s: %v", migration.Version, migration.Name, err)
+	}
+
+	_, err = tx.Exec("INSERT INTO schema_version (version, name, applied) VALUES ($1, $2, $3);", migration.Version, migration.Name, time.Now().Unix())
+	if err != nil {
+		return
+	}
+
+	err = tx.Commit()
+	return err == nil, err
+}
+
+// Migrate : applies migrations newer than the schema version, returns the resulting version.
+// Databases, that were created by hand before migrations were introduced, are upgraded too: migrations do not fail on existing tables.
+func Migrate(db *sql.DB) (version int, err error) {
+	version, err = SchemaVersion(db)
+	if err != nil {
+		return
+	}
+
+	list, err := migrations()
+	if err != nil {
+		return
+	}
+
+	for _, migration := range list {
+		if migration.Version <= version {
+			continue
+		}
+
+		applied, err := applyMigration(db, migration)
+		if err != nil {
+			return version, err
+		}
+
+		if applied {
+			logger.Log.WithField("version", migration.Version).WithField("migration", migration.Name).Info("migration applied")
+		}
+		version = migration.Version
+	}
+	return
+}
@@ -0,0 +1,8 @@
+create table if not exists github_reports (id serial, shahash varchar, status varchar, keyword varchar, owner varchar, info jsonb, url varchar, time integer);
+create table if not exists report_fragments (id serial, content bytea, reject_id integer, report_id integer, shahash varchar, keywords jsonb);
+create table if not exists rejection_rules (id serial, rulename varchar, expr varchar, example varchar);
+
+-- reject_id of a fragment: 0 is new, 1 is manual, 2 is verified, 3 is verified_auto_remove, other ids are regexp rules
+insert into rejection_rules (rulename, expr, example) select 'manual', '', '' where not exists (select 1 from rejection_rules where rulename = 'manual');
+insert into rejection_rules (rulename, expr, example) select 'verified', '', '' where not exists (select 1 from rejection_rules where rulename = 'verified');
+insert into rejection_rules (rulename, expr, example) select 'verified_auto_remove', '', '' where not exists (select 1 from rejection_rules where rulename = 'verified_auto_remove');
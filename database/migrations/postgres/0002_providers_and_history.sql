@@ -0,0 +1,8 @@
+alter table github_reports add column if not exists type varchar default 'github';
+alter table report_fragments add column if not exists commit_sha varchar default '';
+alter table report_fragments add column if not exists commit_author varchar default '';
+alter table report_fragments add column if not exists commit_date integer default 0;
+
+create table if not exists search_shards (id serial, parent_id integer, provider varchar, base_query varchar, query varchar, sized boolean, size_from integer, size_to integer, qualifier varchar, total_count integer, leaf boolean, time integer);
+create table if not exists history_scans (id serial, repo varchar unique, head_sha varchar, time integer);
+create table if not exists search_watermarks (id serial, provider varchar, query varchar, last_sha varchar, total_count integer, time integer, unique (provider, query));
@@ -0,0 +1,4 @@
+alter table report_fragments add column if not exists detectors jsonb default '[]';
+alter table report_fragments add column if not exists confidence real default 0;
+alter table report_fragments add column if not exists internal_keywords jsonb default '[]';
+alter table report_fragments add column if not exists priority integer default 0;
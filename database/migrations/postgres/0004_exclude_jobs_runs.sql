@@ -0,0 +1,4 @@
+create table if not exists exclude_hits (id serial, entry varchar unique, hits integer, time integer);
+create table if not exists jobs (id serial, report_id integer, stage varchar, status varchar, attempts integer, next_attempt integer, last_error varchar, created integer, updated integer, unique (report_id, stage));
+create table if not exists runs (id serial, stage varchar, keywords jsonb, trigger varchar, status varchar, started integer, finished integer, error varchar, queries integer, pages integer, files integer, fragments integer, errors integer);
+create table if not exists schedules (id serial, name varchar unique, spec varchar, last_run integer, next_run integer, status varchar, error varchar);
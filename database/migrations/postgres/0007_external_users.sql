@@ -0,0 +1 @@
+alter table users add column if not exists subject varchar unique;
@@ -0,0 +1,6 @@
+alter table users add column if not exists totp_secret varchar;
+alter table users add column if not exists totp_pending varchar;
+alter table users add column if not exists totp_counter bigint;
+alter table users add column if not exists failed_logins integer;
+alter table users add column if not exists locked_until integer;
+create table if not exists recovery_codes (id serial, user_id integer, code_hash varchar, used integer);
@@ -0,0 +1,2 @@
+alter table github_reports add column if not exists history boolean default false;
+update github_reports set history=true where keyword='history';
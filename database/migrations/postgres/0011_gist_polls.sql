@@ -0,0 +1,2 @@
+create table if not exists gist_polls (id serial, source varchar unique, time integer);
+create table if not exists gist_revisions (id serial, gist_id varchar, version varchar unique, time integer);
@@ -0,0 +1,8 @@
+alter table github_reports add column type varchar default 'github';
+alter table report_fragments add column commit_sha varchar default '';
+alter table report_fragments add column commit_author varchar default '';
+alter table report_fragments add column commit_date integer default 0;
+
+create table if not exists search_shards (id integer primary key autoincrement, parent_id integer, provider varchar, base_query varchar, query varchar, sized boolean, size_from integer, size_to integer, qualifier varchar, total_count integer, leaf boolean, time integer);
+create table if not exists history_scans (id integer primary key autoincrement, repo varchar unique, head_sha varchar, time integer);
+create table if not exists search_watermarks (id integer primary key autoincrement, provider varchar, query varchar, last_sha varchar, total_count integer, time integer, unique (provider, query));
@@ -0,0 +1,4 @@
+alter table report_fragments add column detectors text default '[]';
+alter table report_fragments add column confidence real default 0;
+alter table report_fragments add column internal_keywords text default '[]';
+alter table report_fragments add column priority integer default 0;
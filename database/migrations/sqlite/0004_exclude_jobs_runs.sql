@@ -0,0 +1,4 @@
+create table if not exists exclude_hits (id integer primary key autoincrement, entry varchar unique, hits integer, time integer);
+create table if not exists jobs (id integer primary key autoincrement, report_id integer, stage varchar, status varchar, attempts integer, next_attempt integer, last_error varchar, created integer, updated integer, unique (report_id, stage));
+create table if not exists runs (id integer primary key autoincrement, stage varchar, keywords text, trigger varchar, status varchar, started integer, finished integer, error varchar, queries integer, pages integer, files integer, fragments integer, errors integer);
+create table if not exists schedules (id integer primary key autoincrement, name varchar unique, spec varchar, last_run integer, next_run integer, status varchar, error varchar);
@@ -0,0 +1 @@
+create table if not exists users (id integer primary key autoincrement, username varchar unique, password_hash varchar, role varchar, created integer, updated integer);
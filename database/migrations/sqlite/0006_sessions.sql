@@ -0,0 +1 @@
+create table if not exists sessions (id varchar primary key, user_id integer, csrf_token varchar, created integer, expires integer);
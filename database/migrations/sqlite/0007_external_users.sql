@@ -0,0 +1,2 @@
+alter table users add column subject varchar;
+create unique index if not exists users_subject on users (subject);
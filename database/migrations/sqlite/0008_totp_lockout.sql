@@ -0,0 +1,6 @@
+alter table users add column totp_secret varchar;
+alter table users add column totp_pending varchar;
+alter table users add column totp_counter integer;
+alter table users add column failed_logins integer;
+alter table users add column locked_until integer;
+create table if not exists recovery_codes (id integer primary key autoincrement, user_id integer, code_hash varchar, used integer);
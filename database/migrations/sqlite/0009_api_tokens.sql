@@ -0,0 +1 @@
+create table if not exists api_tokens (id integer primary key autoincrement, user_id integer, name varchar, token_hash varchar unique, scope varchar, created integer, last_used integer);
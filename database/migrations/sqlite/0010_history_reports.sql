@@ -0,0 +1,2 @@
+alter table github_reports add column history boolean default 0;
+update github_reports set history=1 where keyword='history';
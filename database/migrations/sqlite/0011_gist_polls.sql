@@ -0,0 +1,2 @@
+create table if not exists gist_polls (id integer primary key autoincrement, source varchar unique, time integer);
+create table if not exists gist_revisions (id integer primary key autoincrement, gist_id varchar, version varchar unique, time integer);
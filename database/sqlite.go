@@ -0,0 +1,66 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"regexp"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+const sqliteDriverName = "sqlite3_numbered"
+
+// numberedPlaceholder : postgres placeholder ($1), it is the same as ?1 for sqlite.
+// Sqlite treats $1 as a named parameter, that is numbered by its first occurrence in the query.
+var numberedPlaceholder = regexp.MustCompile(`\$(\d+)`)
+
+func rebind(query string) string {
+	return numberedPlaceholder.ReplaceAllString(query, "?$1")
+}
+
+// sqliteDriver : sqlite driver, that accepts queries written for postgres
+type sqliteDriver struct {
+	sqlite3.SQLiteDriver
+}
+
+func (d *sqliteDriver) Open(dsn string) (driver.Conn, error) {
+	conn, err := d.SQLiteDriver.Open(dsn)
+	if err != nil {
+		return nil, err
+	}
+	return &sqliteConn{conn.(*sqlite3.SQLiteConn)}, nil
+}
+
+type sqliteConn struct {
+	*sqlite3.SQLiteConn
+}
+
+func (conn *sqliteConn) Prepare(query string) (driver.Stmt, error) {
+	return conn.SQLiteConn.Prepare(rebind(query))
+}
+
+func (conn *sqliteConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	return conn.SQLiteConn.PrepareContext(ctx, rebind(query))
+}
+
+func (conn *sqliteConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	return conn.SQLiteConn.ExecContext(ctx, rebind(query), args)
+}
+
+func (conn *sqliteConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	return conn.SQLiteConn.QueryContext(ctx, rebind(query), args)
+}
+
+func init() {
+	sql.Register(sqliteDriverName, &sqliteDriver{})
+}
+
+// openSQLite : writers wait for each other instead of failing with "database is locked"
+func openSQLite(path string) (*sql.DB, error) {
+	if path == "" {
+		return nil, fmt.Errorf("sqlite: path is not set")
+	}
+	return sql.Open(sqliteDriverName, fmt.Sprintf("file:%s?_busy_timeout=10000&_journal_mode=WAL&_foreign_keys=on", path))
+}
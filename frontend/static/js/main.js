@@ -1,20 +1,33 @@
+// the csrf token of the session is sent back with every request
+axios.defaults.xsrfCookieName = "XSRF-TOKEN"
+axios.defaults.xsrfHeaderName = "X-XSRF-TOKEN"
+
 HighlightedReport = Vue.component('h-report', {
     props: ["fragment"],
     render(new_el) {
         var text = this.fragment.text
-        var ind  = this.fragment.ids
-        var rootChilds = []
+        var ranges = []
+        var ind  = this.fragment.ids || []
+        var internal = this.fragment.internal_ids || []
+
+        for(var i=0 ;i < ind.length; i += 2){
+            ranges.push({left : ind[i], right : ind[i+1], class : "highlight"})
+        }
+        for(var i=0 ;i < internal.length; i += 2){
+            ranges.push({left : internal[i], right : internal[i+1], class : "highlight-internal"})
+        }
+        ranges.sort(function(a, b){ return a.left - b.left })
 
-        rootChilds.push(new_el("span", {}, text.substring(0, ind[0])))
-        for(var i=0 ;i < ind.length; i += 2)
+        var rootChilds = []
+        var last = 0
+        for(var i=0 ;i < ranges.length; i++)
         {
-            rootChilds.push(new_el("span", {class : "highlight"}, text.substring(ind[i], ind[i+1])))
-            if(i+2 < ind.length){
-                rootChilds.push(new_el("span", {},  text.substring(ind[i+1], ind[i+2])))
-            }
+            rootChilds.push(new_el("span", {},  text.substring(last, ranges[i].left)))
+            rootChilds.push(new_el("span", {class : ranges[i].class}, text.substring(ranges[i].left, ranges[i].right)))
+            last = ranges[i].right
         }
 
-        rootChilds.push(new_el("span", {},  text.substring(ind[ind.length - 1], text.length)))
+        rootChilds.push(new_el("span", {},  text.substring(last, text.length)))
         return divElement = new_el("div", {class:"text-wrap"}, rootChilds) 
     },
   })
@@ -28,6 +41,10 @@ HeadNavigation = Vue.component('h-nav', {
                     name: "Github",
                     path: "/github"
                 },
+                {
+                    name: "Gitlab",
+                    path: "/gitlab"
+                },
                 { 
                     name:"Gist",
                     path:"/gist"
@@ -179,8 +196,9 @@ Settings = Vue.component('settings', {
             info: {
                 db_credentials : {name: "", database: "", password: ""},
                 github : {tokens :[],  langs :[]},
-                globals : {keywords : []}
+                globals : {keywords : [], exclude : []}
             },
+            excludeStats: [],
             ruleNames: [],
             rules: {},
             selected: "",
@@ -193,12 +211,25 @@ Settings = Vue.component('settings', {
             axios.get(requestURI)
                 .then(response => {
                     this.info = response.data
+                    if(!this.info.globals.exclude){
+                        this.info.globals.exclude = []
+                    }
                     console.log(this.info)
                 })
                 .catch(error => {
                     console.log(error)
                 })
         },
+        getExcludeStats: function(){
+            var requestURI = '/api/info/exclude'
+            axios.get(requestURI)
+                .then(response => {
+                    this.excludeStats = response.data
+                })
+                .catch(error => {
+                    console.log(error)
+                })
+        },
         getRules: function(){
             var requestURI = '/api/regexp/get'
             var ruleNames = []
@@ -226,6 +257,8 @@ Settings = Vue.component('settings', {
                 this.info.globals.keywords.push(selected)
             } else if (itemId == 4){
                 this.createRule(selected)
+            } else if (itemId == 5){
+                this.info.globals.exclude.push(selected)
             }
         },
         remove: function(data){
@@ -249,6 +282,11 @@ Settings = Vue.component('settings', {
                 }
             } else if (itemId == 4){
                 this.removeRule(selected)
+            } else if (itemId == 5){
+                elId = this.info.globals.exclude.indexOf(selected)
+                if(elId != -1){
+                    this.info.globals.exclude.splice(elId, 1)
+                }
             }
         },
         update: function(){
@@ -292,6 +330,7 @@ Settings = Vue.component('settings', {
     created : function(){
         this.getInfo()
         this.getRules()
+        this.getExcludeStats()
     },
     template: "#settings-template"
 })
@@ -388,7 +427,7 @@ Fragments = Vue.component('r-fragments', {
             if(status == 1){
                 requestURI += "false"
                 console.log(requestURI)
-                axios.get(requestURI).then(respons=>{
+                axios.post(requestURI, {}).then(respons=>{
                     if(respons.status == 200 && fid != -1){
                         console.log("Yeah")
                         this.fragments.splice(fid, 1)
@@ -401,7 +440,7 @@ Fragments = Vue.component('r-fragments', {
             } else if(status == 2 && rid != -1){
                 console.log(requestURI)
                 requestURI += "valid"
-                axios.get(requestURI).then(
+                axios.post(requestURI, {}).then(
                     response => {
                         if(response.status == 200){
                             var splids = []
@@ -489,6 +528,7 @@ const router = new VueRouter({
     routes :[ 
         {path: "/", component:Fragments, props:{pagetype:"github"}},
         {path: "/github", component:Fragments, props:{pagetype:"github"}},
+        {path: "/gitlab", component:Fragments, props:{pagetype:"gitlab"}},
         {path: "/gist",  component:Fragments, props:{pagetype:"gist"}},
         {path: "/settings",  component:Settings }
     ],
@@ -1,13 +1,19 @@
 package gitsearch
 
 import (
+	"context"
 	"crypto/sha1"
 	"database/sql"
 	"encoding/json"
 	"fmt"
 	"regexp"
+	"strings"
+	"time"
 
+	"../logger"
 	textutils "../utils"
+
+	"github.com/sirupsen/logrus"
 )
 
 // GitDBManager : one structure to rule them all
@@ -79,22 +85,35 @@ func (gitDBManager *GitDBManager) RemoveRule(ruleId int) (err error) {
 }
 
 func (gitDBManager *GitDBManager) insert(report GitReport) (err error) {
+	_, err = gitDBManager.insertReturningId(report)
+	return
+}
+
+func (gitDBManager *GitDBManager) insertReturningId(report GitReport) (id int, err error) {
 	item := report.SearchItem
 	info, err := json.Marshal(item)
 
 	if err != nil {
-		return err
+		return
+	}
+
+	reportType := report.Type
+	if reportType == "" {
+		reportType = ReportTypeGithub
 	}
 
-	_, err = gitDBManager.Database.Exec("INSERT INTO github_reports (shahash, status, keyword, owner, info, url, time) VALUES ($1, $2, $3, $4, $5, $6, $7);",
+	row := gitDBManager.Database.QueryRow("INSERT INTO github_reports (shahash, status, keyword, owner, info, url, time, type, history) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9) RETURNING id;",
 		item.ShaHash,
 		report.Status,
 		report.Query,
 		item.Repo.Owner.Login,
 		info,
 		item.GitUrl,
-		report.Time)
+		report.Time,
+		reportType,
+		report.History)
 
+	err = row.Scan(&id)
 	return
 }
 
@@ -109,15 +128,36 @@ func (gitDBManager *GitDBManager) insertTextFragment(report GitReport, fragment
 		return err
 	}
 
+	internalKeywords := make([]int, 0, len(fragment.InternalIndices))
+	for _, ind := range fragment.InternalIndices {
+		internalKeywords = append(internalKeywords, ind-fragment.Left)
+	}
+	internalJson, err := json.Marshal(internalKeywords)
+	if err != nil {
+		return err
+	}
+
+	hitsJson, err := json.Marshal(fragment.Hits)
+	if err != nil {
+		return err
+	}
+
 	content := []byte(text[fragment.Left:fragment.Right])
 	shahash := fmt.Sprintf("%x", sha1.Sum(content))
 
-	_, err = gitDBManager.Database.Exec("INSERT INTO report_fragments (content, reject_id, report_id, shahash, keywords) VALUES ($1, $2, $3, $4, $5);",
+	_, err = gitDBManager.Database.Exec("INSERT INTO report_fragments (content, reject_id, report_id, shahash, keywords, commit_sha, commit_author, commit_date, detectors, confidence, internal_keywords, priority) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12);",
 		content,
 		0,
 		report.Id,
 		shahash,
-		kwJson)
+		kwJson,
+		report.Commit.Sha,
+		report.Commit.Author,
+		report.Commit.Date,
+		hitsJson,
+		textutils.MaxConfidence(fragment.Hits),
+		internalJson,
+		fragment.Priority)
 
 	return err
 }
@@ -153,17 +193,21 @@ func (gitDBManager *GitDBManager) check(item GitSearchItem) (exist bool, err err
 	return
 }
 
-func (gitDBManager *GitDBManager) SelectReportByStatus(status string) (results chan GitReport, err error) {
-	rows, err := gitDBManager.Database.Query("SELECT id, status, keyword, info, time FROM github_reports WHERE status=$1 ORDER BY time;", status)
+func (gitDBManager *GitDBManager) SelectReportByStatus(ctx context.Context, status string) (results chan GitReport, err error) {
+	rows, err := gitDBManager.Database.QueryContext(ctx, "SELECT id, status, keyword, info, time, type FROM github_reports WHERE status=$1 ORDER BY time;", status)
+	return scanReports(ctx, rows, err)
+}
+
+// scanReports : reports are sent, until the context is canceled, so the rows are closed, when the reader stops early
+func scanReports(ctx context.Context, rows *sql.Rows, err error) (results chan GitReport, _ error) {
 	results = make(chan GitReport, 512)
 
 	if err != nil {
 		close(results)
-		return
+		return results, err
 	}
 
 	go func() {
-		defer fmt.Println("Job channel closed!")
 		defer close(results)
 		defer rows.Close()
 
@@ -171,24 +215,29 @@ func (gitDBManager *GitDBManager) SelectReportByStatus(status string) (results c
 			var gitReport GitReport
 			var reportJsonb []byte
 
-			rows.Scan(&gitReport.Id, &gitReport.Status, &gitReport.Query, &reportJsonb, &gitReport.Time)
+			rows.Scan(&gitReport.Id, &gitReport.Status, &gitReport.Query, &reportJsonb, &gitReport.Time, &gitReport.Type)
 			json.Unmarshal(reportJsonb, &gitReport.SearchItem)
-			results <- gitReport
+
+			select {
+			case results <- gitReport:
+			case <-ctx.Done():
+				return
+			}
 		}
 		return
 	}()
 
-	return
+	return results, nil
 }
 
 func (gitDBManager *GitDBManager) selectReportById(id int) (gitReport GitReport, err error) {
 	var reportJsonb []byte
 
-	reportQuery := "SELECT id, status, keyword, info, time FROM github_reports "
+	reportQuery := "SELECT id, status, keyword, info, time, type FROM github_reports "
 	reportQuery += "WHERE id=$1;"
 
 	row := gitDBManager.Database.QueryRow(reportQuery, id)
-	err = row.Scan(&gitReport.Id, &gitReport.Status, &gitReport.Query, &reportJsonb, &gitReport.Time)
+	err = row.Scan(&gitReport.Id, &gitReport.Status, &gitReport.Query, &reportJsonb, &gitReport.Time, &gitReport.Type)
 
 	if err != nil {
 		return
@@ -203,12 +252,18 @@ func (gitDBManager *GitDBManager) selectReportById(id int) (gitReport GitReport,
 }
 
 // QueryWebReport : generates high level report
-func (gitDBManager *GitDBManager) QueryWebReport(limit, offset int, status string, rejectId int) (webReport WebUIResult, err error) {
-	query := "SELECT a.id, a.content, a.report_id, a.reject_id, a.shahash, a.keywords FROM (SELECT * "
-	query += "FROM report_fragments WHERE reject_id=$1) a INNER JOIN "
-	query += "(SELECT id, time from github_reports  WHERE status=$2) s ON a.report_id=s.id ORDER BY time LIMIT $3 OFFSET $4;"
+func (gitDBManager *GitDBManager) QueryWebReport(limit, offset int, reportType, status string, rejectId int, filter FragmentFilter) (webReport WebUIResult, err error) {
+	fragmentFilter := "($%d::text = '' OR detectors @> jsonb_build_array(jsonb_build_object('name', $%d::text))) AND confidence >= $%d"
+	return gitDBManager.queryWebReport(fragmentFilter, limit, offset, reportType, status, rejectId, filter)
+}
 
-	rows, err := gitDBManager.Database.Query(query, rejectId, status, limit, offset)
+// queryWebReport : fragmentFilter is the condition on detectors and confidence with placeholders of the detector (twice) and the confidence
+func (gitDBManager *GitDBManager) queryWebReport(fragmentFilter string, limit, offset int, reportType, status string, rejectId int, filter FragmentFilter) (webReport WebUIResult, err error) {
+	query := "SELECT a.id, a.content, a.report_id, a.reject_id, a.shahash, a.keywords, a.commit_sha, a.commit_author, a.commit_date, a.detectors, a.confidence, a.internal_keywords, a.priority FROM (SELECT * "
+	query += "FROM report_fragments WHERE reject_id=$1 AND " + fmt.Sprintf(fragmentFilter, 6, 6, 7) + ") a INNER JOIN "
+	query += "(SELECT id, time from github_reports  WHERE status=$2 AND type=$5) s ON a.report_id=s.id ORDER BY a.priority DESC, time LIMIT $3 OFFSET $4;"
+
+	rows, err := gitDBManager.Database.Query(query, rejectId, status, limit, offset, reportType, filter.Detector, filter.MinConfidence)
 	results := make(chan TextFragment, 512)
 
 	if err != nil {
@@ -224,15 +279,28 @@ func (gitDBManager *GitDBManager) QueryWebReport(limit, offset int, status strin
 			var textFragment TextFragment
 			var content []byte
 			var kwJson []byte
+			var hitsJson []byte
+			var internalJson []byte
 
-			rows.Scan(&textFragment.Id, &content, &textFragment.ReportId, &textFragment.RejectId, &textFragment.ShaHash, &kwJson)
+			rows.Scan(&textFragment.Id, &content, &textFragment.ReportId, &textFragment.RejectId, &textFragment.ShaHash, &kwJson,
+				&textFragment.Sha, &textFragment.Author, &textFragment.Date, &hitsJson, &textFragment.Confidence, &internalJson, &textFragment.Priority)
 			json.Unmarshal(kwJson, &textFragment.KeywordIndices)
+			json.Unmarshal(hitsJson, &textFragment.Detectors)
+			json.Unmarshal(internalJson, &textFragment.InternalIndices)
 			textFragment.Text = string(content)
+			textFragment.Detectors = textutils.ConvertHitsToRunes(textFragment.Text, textFragment.Detectors)
+
+			if len(textFragment.InternalIndices) > 0 {
+				textFragment.InternalIndices, err = textutils.ConvertFragmentToRunes(textFragment.Text, textFragment.InternalIndices)
+				if err != nil {
+					logger.Log.WithError(err).WithField("fragment_id", textFragment.Id).Warn("invalid internal keyword indices")
+					textFragment.InternalIndices = nil
+				}
+			}
 			textFragment.KeywordIndices, err = textutils.ConvertFragmentToRunes(textFragment.Text, textFragment.KeywordIndices)
 
 			if err != nil {
-				fmt.Println(err.Error())
-				fmt.Printf("FragmentID: %d ReportID: %d\n", textFragment.Id, textFragment.ReportId)
+				logger.Log.WithError(err).WithFields(logrus.Fields{"fragment_id": textFragment.Id, "report_id": textFragment.ReportId}).Warn("invalid keyword indices")
 				continue
 			}
 
@@ -242,12 +310,12 @@ func (gitDBManager *GitDBManager) QueryWebReport(limit, offset int, status strin
 	}()
 
 	tcQuery := "SELECT count(a.id) FROM (SELECT id, report_id "
-	tcQuery += "FROM report_fragments WHERE reject_id=$1) a "
-	tcQuery += "INNER JOIN (SELECT id, time from github_reports  WHERE status=$2) s "
+	tcQuery += "FROM report_fragments WHERE reject_id=$1 AND " + fmt.Sprintf(fragmentFilter, 4, 4, 5) + ") a "
+	tcQuery += "INNER JOIN (SELECT id, time from github_reports  WHERE status=$2 AND type=$3) s "
 	tcQuery += "ON a.report_id=s.id;"
 
 	webReport.Fragments = make([]TextFragment, 0, 512)
-	row := gitDBManager.Database.QueryRow(tcQuery, rejectId, status)
+	row := gitDBManager.Database.QueryRow(tcQuery, rejectId, status, reportType, filter.Detector, filter.MinConfidence)
 	err = row.Scan(&webReport.TotalCount)
 
 	if err != nil {
@@ -313,3 +381,406 @@ func (gitDBManager *GitDBManager) getFragmentReportId(fragmentId int) (reportId
 	err = row.Scan(&reportId)
 	return
 }
+
+// reportCount : number of reports with the status and type
+type reportCount struct {
+	Status string `json:"status"`
+	Type   string `json:"type"`
+	Count  int    `json:"count"`
+}
+
+func (gitDBManager *GitDBManager) countReportsByStatus() (counts []reportCount, err error) {
+	query := "SELECT status, type, count(*) FROM github_reports GROUP BY status, type;"
+	rows, err := gitDBManager.Database.Query(query)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var count reportCount
+		err = rows.Scan(&count.Status, &count.Type, &count.Count)
+		if err != nil {
+			return
+		}
+		counts = append(counts, count)
+	}
+	err = rows.Err()
+	return
+}
+
+// getGistPoll : start of the last complete poll of the gist list (0 if it was never polled)
+func (gitDBManager *GitDBManager) getGistPoll(source string) (pollTime int64, err error) {
+	row := gitDBManager.Database.QueryRow("SELECT time FROM gist_polls WHERE source=$1;", source)
+	err = row.Scan(&pollTime)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return
+}
+
+func (gitDBManager *GitDBManager) setGistPoll(source string, pollTime int64) (err error) {
+	query := "INSERT INTO gist_polls (source, time) VALUES ($1, $2) ON CONFLICT (source) DO UPDATE SET time=$2;"
+	_, err = gitDBManager.Database.Exec(query, source, pollTime)
+	return
+}
+
+// gistRevisionExist : the revision is already scanned, revisions of a gist never change
+func (gitDBManager *GitDBManager) gistRevisionExist(version string) (exist bool, err error) {
+	row := gitDBManager.Database.QueryRow("SELECT EXISTS (SELECT 1 FROM gist_revisions WHERE version=$1);", version)
+	err = row.Scan(&exist)
+	return
+}
+
+func (gitDBManager *GitDBManager) insertGistRevision(gistId, version string) (err error) {
+	query := "INSERT INTO gist_revisions (gist_id, version, time) VALUES ($1, $2, $3) ON CONFLICT (version) DO NOTHING;"
+	_, err = gitDBManager.Database.Exec(query, gistId, version, time.Now().Unix())
+	return
+}
+
+func (gitDBManager *GitDBManager) getShardLeaves(provider, baseQuery string) (shards []SearchShard, err error) {
+	query := "SELECT id, parent_id, provider, base_query, query, sized, size_from, size_to, qualifier, total_count, leaf, time "
+	query += "FROM search_shards WHERE provider=$1 AND base_query=$2 AND leaf=true ORDER BY id;"
+
+	rows, err := gitDBManager.Database.Query(query, provider, baseQuery)
+	if err != nil {
+		return
+	}
+
+	defer rows.Close()
+	for rows.Next() {
+		var shard SearchShard
+		err = rows.Scan(&shard.Id, &shard.ParentId, &shard.Provider, &shard.BaseQuery, &shard.Query, &shard.Sized,
+			&shard.SizeFrom, &shard.SizeTo, &shard.Qualifier, &shard.TotalCount, &shard.Leaf, &shard.Time)
+		if err != nil {
+			return
+		}
+
+		shards = append(shards, shard)
+	}
+	return
+}
+
+// insertShard : new shards are not probed yet (time 0), so they are probed by the next run, when the current one skips them
+func (gitDBManager *GitDBManager) insertShard(shard SearchShard) (id int, err error) {
+	query := "INSERT INTO search_shards (parent_id, provider, base_query, query, sized, size_from, size_to, qualifier, total_count, leaf, time) "
+	query += "VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11) RETURNING id;"
+
+	row := gitDBManager.Database.QueryRow(query, shard.ParentId, shard.Provider, shard.BaseQuery, shard.Query, shard.Sized,
+		shard.SizeFrom, shard.SizeTo, shard.Qualifier, shard.TotalCount, shard.Leaf, shard.Time)
+	err = row.Scan(&id)
+	return
+}
+
+func (gitDBManager *GitDBManager) updateShard(shard SearchShard) (err error) {
+	query := "UPDATE search_shards SET total_count=$1, leaf=$2, time=$3 WHERE id=$4;"
+	_, err = gitDBManager.Database.Exec(query, shard.TotalCount, shard.Leaf, time.Now().Unix(), shard.Id)
+	return
+}
+
+func (gitDBManager *GitDBManager) setWatermark(watermark SearchWatermark) (err error) {
+	query := "INSERT INTO search_watermarks (provider, query, last_sha, total_count, time) VALUES ($1, $2, $3, $4, $5) "
+	query += "ON CONFLICT (provider, query) DO UPDATE SET last_sha=$3, total_count=$4, time=$5;"
+
+	_, err = gitDBManager.Database.Exec(query, watermark.Provider, watermark.Query, watermark.LastSha, watermark.TotalCount, watermark.Time)
+	return
+}
+
+// getWatermark : newest result of the last completed walk of the query
+func (gitDBManager *GitDBManager) getWatermark(provider, searchQuery string) (watermark SearchWatermark, exist bool, err error) {
+	query := "SELECT provider, query, last_sha, total_count, time FROM search_watermarks WHERE provider=$1 AND query=$2;"
+	row := gitDBManager.Database.QueryRow(query, provider, searchQuery)
+	err = row.Scan(&watermark.Provider, &watermark.Query, &watermark.LastSha, &watermark.TotalCount, &watermark.Time)
+	if err == sql.ErrNoRows {
+		return watermark, false, nil
+	}
+	return watermark, err == nil, err
+}
+
+// selectHistoryCandidates : reports of repositories, that have verified or new findings
+func (gitDBManager *GitDBManager) selectHistoryCandidates() (reports []GitReport, err error) {
+	query := "SELECT id, status, keyword, info, time, type FROM github_reports r WHERE NOT history AND "
+	query += "(status='verified' OR EXISTS (SELECT 1 FROM report_fragments f WHERE f.report_id=r.id AND f.reject_id=0)) ORDER BY time;"
+
+	rows, err := gitDBManager.Database.Query(query)
+	results, err := scanReports(context.Background(), rows, err)
+	if err != nil {
+		return
+	}
+
+	for report := range results {
+		reports = append(reports, report)
+	}
+	return
+}
+
+// getHistoryHeads : branch heads of the previous scan, they are stored space separated
+func (gitDBManager *GitDBManager) getHistoryHeads(repo string) (heads []string, err error) {
+	var stored string
+	row := gitDBManager.Database.QueryRow("SELECT head_sha FROM history_scans WHERE repo=$1;", repo)
+	err = row.Scan(&stored)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return strings.Fields(stored), err
+}
+
+func (gitDBManager *GitDBManager) setHistoryHeads(repo string, heads []string) (err error) {
+	query := "INSERT INTO history_scans (repo, head_sha, time) VALUES ($1, $2, $3) "
+	query += "ON CONFLICT (repo) DO UPDATE SET head_sha=$2, time=$3;"
+	_, err = gitDBManager.Database.Exec(query, repo, strings.Join(heads, " "), time.Now().Unix())
+	return
+}
+
+func (gitDBManager *GitDBManager) incrementExcludeHits(entry string) (err error) {
+	query := "INSERT INTO exclude_hits (entry, hits, time) VALUES ($1, 1, $2) "
+	query += "ON CONFLICT (entry) DO UPDATE SET hits=exclude_hits.hits+1, time=$2;"
+
+	_, err = gitDBManager.Database.Exec(query, entry, time.Now().Unix())
+	return
+}
+
+func (gitDBManager *GitDBManager) selectExcludeHits() (hits map[string]ExcludeStat, err error) {
+	rows, err := gitDBManager.Database.Query("SELECT entry, hits, time FROM exclude_hits;")
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	hits = make(map[string]ExcludeStat)
+	for rows.Next() {
+		var stat ExcludeStat
+		err = rows.Scan(&stat.Entry, &stat.Hits, &stat.LastHit)
+		if err != nil {
+			return
+		}
+		hits[stat.Entry] = stat
+	}
+	err = rows.Err()
+	return
+}
+
+const dueReportsQuery = "SELECT r.id, r.status, r.keyword, r.info, r.time, r.type FROM github_reports r " +
+	"LEFT JOIN jobs j ON j.report_id=r.id AND j.stage=$2 " +
+	"WHERE r.status=$1 AND (%s OR r.type=$3) AND (j.id IS NULL OR (j.status=$4 AND j.next_attempt <= $5)) ORDER BY r.time;"
+
+// selectDueReports : reports with the status, that have no pending attempt of the stage in the future ("" type for all types)
+func (gitDBManager *GitDBManager) selectDueReports(ctx context.Context, status, stage, reportType string) (results chan GitReport, err error) {
+	return gitDBManager.queryDueReports(ctx, fmt.Sprintf(dueReportsQuery, "$3::text = ''"), status, stage, reportType)
+}
+
+func (gitDBManager *GitDBManager) queryDueReports(ctx context.Context, query, status, stage, reportType string) (results chan GitReport, err error) {
+	rows, err := gitDBManager.Database.QueryContext(ctx, query, status, stage, reportType, JobStatusPending, time.Now().Unix())
+	return scanReports(ctx, rows, err)
+}
+
+func (gitDBManager *GitDBManager) recordJobFailure(reportId int, stage, lastError string) (job Job, err error) {
+	query := "INSERT INTO jobs (report_id, stage, status, attempts, next_attempt, last_error, created, updated) VALUES ($1, $2, $3, 1, 0, $4, $5, $5) "
+	query += "ON CONFLICT (report_id, stage) DO UPDATE SET attempts=jobs.attempts+1, last_error=$4, updated=$5 RETURNING id, attempts;"
+
+	row := gitDBManager.Database.QueryRow(query, reportId, stage, JobStatusPending, lastError, time.Now().Unix())
+	err = row.Scan(&job.Id, &job.Attempts)
+	return
+}
+
+func (gitDBManager *GitDBManager) setJobNextAttempt(jobId int, status string, nextAttempt int64) (err error) {
+	query := "UPDATE jobs SET status=$1, next_attempt=$2, updated=$3 WHERE id=$4;"
+	_, err = gitDBManager.Database.Exec(query, status, nextAttempt, time.Now().Unix(), jobId)
+	return
+}
+
+func (gitDBManager *GitDBManager) completeJob(reportId int, stage string) (err error) {
+	query := "INSERT INTO jobs (report_id, stage, status, attempts, next_attempt, last_error, created, updated) VALUES ($1, $2, $3, 0, 0, '', $4, $4) "
+	query += "ON CONFLICT (report_id, stage) DO UPDATE SET status=$3, updated=$4;"
+
+	_, err = gitDBManager.Database.Exec(query, reportId, stage, JobStatusDone, time.Now().Unix())
+	return
+}
+
+func (gitDBManager *GitDBManager) requeueJob(jobId int) (err error) {
+	query := "UPDATE jobs SET status=$1, attempts=0, next_attempt=0, updated=$2 WHERE id=$3;"
+	_, err = gitDBManager.Database.Exec(query, JobStatusPending, time.Now().Unix(), jobId)
+	return
+}
+
+func scanJob(scan func(dest ...interface{}) error) (job Job, err error) {
+	var reportJsonb []byte
+
+	err = scan(&job.Id, &job.ReportId, &job.Stage, &job.Status, &job.Attempts, &job.NextAttempt, &job.LastError, &job.Updated, &reportJsonb)
+	if err != nil {
+		return
+	}
+
+	err = json.Unmarshal(reportJsonb, &job.Report)
+	return
+}
+
+const jobColumns = "j.id, j.report_id, j.stage, j.status, j.attempts, j.next_attempt, j.last_error, j.updated, r.info FROM jobs j INNER JOIN github_reports r ON j.report_id=r.id "
+
+func (gitDBManager *GitDBManager) selectJobById(jobId int) (job Job, err error) {
+	row := gitDBManager.Database.QueryRow("SELECT "+jobColumns+"WHERE j.id=$1;", jobId)
+	return scanJob(row.Scan)
+}
+
+// selectJobs : jobs with the status ("" for all), limit 0 returns all of them
+func (gitDBManager *GitDBManager) selectJobs(status string, limit, offset int) (jobs []Job, err error) {
+	query := "SELECT " + jobColumns
+	query += "WHERE ($1::text = '' OR j.status=$1) ORDER BY j.updated DESC LIMIT NULLIF($2, 0) OFFSET $3;"
+	return gitDBManager.queryJobs(query, status, limit, offset)
+}
+
+func (gitDBManager *GitDBManager) queryJobs(query string, args ...interface{}) (jobs []Job, err error) {
+	rows, err := gitDBManager.Database.Query(query, args...)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	jobs = make([]Job, 0, 64)
+	for rows.Next() {
+		var job Job
+		job, err = scanJob(rows.Scan)
+		if err != nil {
+			return
+		}
+		jobs = append(jobs, job)
+	}
+	err = rows.Err()
+	return
+}
+
+func (gitDBManager *GitDBManager) selectScheduleRuns() (runs map[string]ScheduleRun, err error) {
+	rows, err := gitDBManager.Database.Query("SELECT name, spec, last_run, next_run, status, error FROM schedules;")
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	runs = make(map[string]ScheduleRun)
+	for rows.Next() {
+		var run ScheduleRun
+		err = rows.Scan(&run.Name, &run.Spec, &run.LastRun, &run.NextRun, &run.Status, &run.Error)
+		if err != nil {
+			return
+		}
+		runs[run.Name] = run
+	}
+	err = rows.Err()
+	return
+}
+
+func (gitDBManager *GitDBManager) saveScheduleRun(run ScheduleRun) (err error) {
+	query := "INSERT INTO schedules (name, spec, last_run, next_run, status, error) VALUES ($1, $2, $3, $4, $5, $6) "
+	query += "ON CONFLICT (name) DO UPDATE SET spec=$2, last_run=$3, next_run=$4, status=$5, error=$6;"
+
+	_, err = gitDBManager.Database.Exec(query, run.Name, run.Spec, run.LastRun, run.NextRun, run.Status, run.Error)
+	return
+}
+
+func (gitDBManager *GitDBManager) insertRun(run Run) (id int, err error) {
+	keywords, err := json.Marshal(run.Keywords)
+	if err != nil {
+		return
+	}
+
+	query := "INSERT INTO runs (stage, keywords, trigger, status, started, finished, error, queries, pages, files, fragments, errors) "
+	query += "VALUES ($1, $2, $3, $4, $5, 0, '', 0, 0, 0, 0, 0) RETURNING id;"
+
+	row := gitDBManager.Database.QueryRow(query, run.Stage, keywords, run.Trigger, run.Status, run.Started)
+	err = row.Scan(&id)
+	return
+}
+
+func (gitDBManager *GitDBManager) finishRun(id int, status, runError string, finished int64, stats RunStats) (err error) {
+	query := "UPDATE runs SET status=$1, error=$2, finished=$3, queries=$4, pages=$5, files=$6, fragments=$7, errors=$8 WHERE id=$9;"
+	_, err = gitDBManager.Database.Exec(query, status, runError, finished, stats.Queries, stats.Pages, stats.Files, stats.Fragments, stats.Errors, id)
+	return
+}
+
+const runColumns = "id, stage, keywords, trigger, status, started, finished, error, queries, pages, files, fragments, errors FROM runs "
+
+// selectRuns : runs newest first, limit 0 returns all of them
+func (gitDBManager *GitDBManager) selectRuns(limit, offset int) (runs []Run, err error) {
+	query := "SELECT " + runColumns + "ORDER BY id DESC LIMIT NULLIF($1, 0) OFFSET $2;"
+	return gitDBManager.queryRuns(query, limit, offset)
+}
+
+func (gitDBManager *GitDBManager) queryRuns(query string, args ...interface{}) (runs []Run, err error) {
+	rows, err := gitDBManager.Database.Query(query, args...)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	runs = make([]Run, 0, 64)
+	for rows.Next() {
+		var run Run
+		var keywords []byte
+
+		err = rows.Scan(&run.Id, &run.Stage, &keywords, &run.Trigger, &run.Status, &run.Started, &run.Finished, &run.Error,
+			&run.Queries, &run.Pages, &run.Files, &run.Fragments, &run.Errors)
+		if err != nil {
+			return
+		}
+
+		json.Unmarshal(keywords, &run.Keywords)
+		runs = append(runs, run)
+	}
+	err = rows.Err()
+	return
+}
+
+// lastFinishedRun : finish time of the most recent run of the stages with the status (0 if there is none)
+func (gitDBManager *GitDBManager) lastFinishedRun(status string, stages []string) (finished int64, err error) {
+	stagesJson, err := json.Marshal(stages)
+	if err != nil {
+		return
+	}
+
+	query := "SELECT COALESCE(MAX(finished), 0) FROM runs WHERE status=$1 AND stage IN (SELECT jsonb_array_elements_text($2::jsonb));"
+	row := gitDBManager.Database.QueryRow(query, status, stagesJson)
+	err = row.Scan(&finished)
+	return
+}
+
+func (gitDBManager *GitDBManager) deleteReportFragments(reportId int) (err error) {
+	_, err = gitDBManager.Database.Exec("DELETE FROM report_fragments WHERE report_id=$1;", reportId)
+	return
+}
+
+// deleteReport : removes the report with its fragments
+func (gitDBManager *GitDBManager) deleteReport(reportId int) (err error) {
+	err = gitDBManager.deleteReportFragments(reportId)
+	if err != nil {
+		return
+	}
+
+	_, err = gitDBManager.Database.Exec("DELETE FROM github_reports WHERE id=$1;", reportId)
+	return
+}
+
+// rollbackInterruptedReports : see RecoverInterruptedWork
+func (gitDBManager *GitDBManager) rollbackInterruptedReports() (err error) {
+	query := "DELETE FROM report_fragments WHERE report_id IN "
+	query += "(SELECT id FROM github_reports WHERE status='fetched' OR status=$1);"
+
+	_, err = gitDBManager.Database.Exec(query, ReportStatusHistory)
+	if err != nil {
+		return
+	}
+
+	_, err = gitDBManager.Database.Exec("DELETE FROM github_reports WHERE status=$1;", ReportStatusHistory)
+	return
+}
+
+// markInterruptedRuns : runs and schedules, that were running during the shutdown
+func (gitDBManager *GitDBManager) markInterruptedRuns() (err error) {
+	_, err = gitDBManager.Database.Exec("UPDATE runs SET status='interrupted', finished=$1 WHERE status=$2;", time.Now().Unix(), RunStatusRunning)
+	if err != nil {
+		return
+	}
+
+	// next run of the schedule is updated after the run, so the interrupted schedule is still due
+	_, err = gitDBManager.Database.Exec("UPDATE schedules SET status='interrupted' WHERE status=$1;", RunStatusRunning)
+	return
+}
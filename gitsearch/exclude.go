@@ -0,0 +1,129 @@
+package gitsearch
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strings"
+
+	"../config"
+)
+
+// Exclude list entry kinds (globals.exclude in Config.json): owner:<login>, repo:<owner/name>, path:<glob>, ext:<extension>, fork.
+// Entry without prefix is a repo, when it contains "/", and an owner otherwise
+const (
+	excludeOwner     = "owner"
+	excludeRepo      = "repo"
+	excludePath      = "path"
+	excludeExtension = "ext"
+	excludeFork      = "fork"
+)
+
+// ExcludeRule : parsed entry of the exclude list
+type ExcludeRule struct {
+	Entry string
+	Kind  string
+	Value string
+}
+
+// ExcludeStat : exclude list entry with the number of suppressed search items
+type ExcludeStat struct {
+	Entry   string `json:"entry"`
+	Hits    int    `json:"hits"`
+	LastHit int64  `json:"last_hit"`
+}
+
+func parseExcludeRule(entry string) (rule ExcludeRule, err error) {
+	rule.Entry = entry
+	entry = strings.TrimSpace(entry)
+
+	if entry == excludeFork || entry == excludeFork+":true" {
+		rule.Kind = excludeFork
+		return
+	}
+
+	parts := strings.SplitN(entry, ":", 2)
+	if len(parts) == 2 {
+		rule.Kind, rule.Value = strings.ToLower(parts[0]), parts[1]
+	} else if strings.Contains(entry, "/") {
+		rule.Kind, rule.Value = excludeRepo, entry
+	} else {
+		rule.Kind, rule.Value = excludeOwner, entry
+	}
+
+	switch rule.Kind {
+	case excludeOwner, excludeRepo:
+		rule.Value = strings.ToLower(rule.Value)
+	case excludePath:
+		_, err = path.Match(rule.Value, "")
+	case excludeExtension:
+		rule.Value = "." + strings.TrimPrefix(strings.ToLower(rule.Value), ".")
+	default:
+		err = fmt.Errorf("exclude list: unknown entry %q", rule.Entry)
+	}
+
+	if rule.Value == "" && err == nil {
+		err = fmt.Errorf("exclude list: empty entry %q", rule.Entry)
+	}
+	return
+}
+
+// excludeRules : rules from config, invalid entries are logged and skipped
+func excludeRules(ctx context.Context) (rules []ExcludeRule) {
+	for _, entry := range config.Settings.Globals.ExcludeList {
+		rule, err := parseExcludeRule(entry)
+		if err != nil {
+			stageLog(ctx, RunStageSearch).WithError(err).Warn("invalid exclude list entry")
+			continue
+		}
+		rules = append(rules, rule)
+	}
+	return
+}
+
+func (rule *ExcludeRule) match(item GitSearchItem) bool {
+	switch rule.Kind {
+	case excludeOwner:
+		return strings.ToLower(item.Repo.Owner.Login) == rule.Value
+	case excludeRepo:
+		return strings.ToLower(item.Repo.FullName) == rule.Value
+	case excludePath:
+		if matched, _ := path.Match(rule.Value, item.Path); matched {
+			return true
+		}
+		matched, _ := path.Match(rule.Value, path.Base(item.Path))
+		return matched
+	case excludeExtension:
+		return strings.ToLower(path.Ext(item.Path)) == rule.Value
+	case excludeFork:
+		return item.Repo.Fork
+	}
+	return false
+}
+
+// excluded : first rule, that matches the item
+func excluded(item GitSearchItem, rules []ExcludeRule) (rule ExcludeRule, matched bool) {
+	for _, rule = range rules {
+		if rule.match(item) {
+			return rule, true
+		}
+	}
+	return ExcludeRule{}, false
+}
+
+// ExcludeStats : entries of the exclude list with their hit counters
+func ExcludeStats() (stats []ExcludeStat, err error) {
+	dbManager := NewStorage()
+	hits, err := dbManager.selectExcludeHits()
+	if err != nil {
+		return
+	}
+
+	stats = make([]ExcludeStat, 0, len(config.Settings.Globals.ExcludeList))
+	for _, entry := range config.Settings.Globals.ExcludeList {
+		stat := hits[entry]
+		stat.Entry = entry
+		stats = append(stats, stat)
+	}
+	return
+}
@@ -2,104 +2,140 @@ package gitsearch
 
 import (
 	"context"
-	"fmt"
 	"sync"
+	"sync/atomic"
 
 	"../config"
-	"../database"
 	textutils "../utils"
 )
 
-func gitExtractionWorker(ctx context.Context, id int, jobchan chan GitReport, errchan chan string, wg *sync.WaitGroup) {
+func gitExtractionWorker(ctx context.Context, id int, rejectRules []textutils.RejectRule, jobchan chan GitReport, wg *sync.WaitGroup) {
 	defer wg.Done()
 	contentDir := config.Settings.Globals.ContentDir
 	keywords := config.Settings.Globals.Keywords
-	dbManager := GitDBManager{database.DB}
-
-	rejectRules, err := dbManager.GetRules()
-	if err != nil {
-		errchan <- pError(err)
-		return
-	}
+	internalKeywords := config.Settings.Globals.InternalKeywords
+	dbManager := NewStorage()
 
 	for report := range jobchan {
+		log := reportLog(ctx, RunStageExtract, report)
 		shaHash := report.SearchItem.ShaHash
 		fName := contentDir + shaHash
 		fData, err := textutils.ReadFile(fName)
 		if err != nil {
-			errchan <- pError(err)
+			failAttempt(log, report, JobStageExtract, err)
+			continue
+		}
+
+		// fragments of the interrupted or failed attempt are replaced
+		err = dbManager.deleteReportFragments(report.Id)
+		if err != nil {
+			log.WithError(err).Error("can not delete fragments")
 			continue
 		}
 
 		text := string(fData)
-		text = textutils.TrimS(text)
-		textFragments, err := textutils.GenTextFragments(text, keywords, 480, 640, 5)
+		nFragments, err := extractFragments(dbManager, report, text, keywords, internalKeywords, rejectRules)
+		atomic.AddInt64(&runStats(ctx).Fragments, int64(nFragments))
+		if err != nil {
+			failAttempt(log, report, JobStageExtract, err)
+			continue
+		}
 
+		err = dbManager.UpdateStatus(report.Id, "fragmented")
 		if err != nil {
-			errchan <- pError(err)
+			log.WithError(err).Error("can not update report status")
 			continue
 		}
 
-		// select valid fragments, that does not match any of reject rules
-		var validFragments []textutils.Fragment
-		if len(rejectRules) > 0 {
-			validFragments = make([]textutils.Fragment, 0, len(textFragments))
-
-			for _, fragment := range textFragments {
-				matchId := textutils.CheckFragment(text, fragment, rejectRules)
-
-				// if something is mathched, then insert matched fragment in database
-				if matchId != 0 {
-					err = dbManager.insertTextFragment(report, fragment, text, matchId)
-					if err != nil {
-						break
-					}
-				} else {
-					validFragments = append(validFragments, fragment)
-				}
-			}
+		log.WithField("fragments", nFragments).Debug("fragments extracted")
+		err = completeJob(report, JobStageExtract)
+		if err != nil {
+			log.WithError(err).Error("can not complete job")
+		}
 
-			if err != nil {
-				errchan <- pError(err)
-				continue
-			}
-		} else {
-			validFragments = textFragments
+		select {
+		case <-ctx.Done():
+			return
+		default:
 		}
+	}
+}
 
-		// join valid fragments, that are close to each other
-		// that reduces total amount of fragments
-		validFragments, err = textutils.UnionFragments(validFragments, 640)
-		for _, fragment := range validFragments {
-			err = dbManager.insertTextFragment(report, fragment, text, 0)
+// extractFragments : stores fragments of the text, that contain keywords, internal keywords only raise priority of the fragments.
+// Returns the number of stored fragments
+func extractFragments(dbManager Storage, report GitReport, text string, keywords, internalKeywords []string, rejectRules []textutils.RejectRule) (nFragments int, err error) {
+	text = textutils.TrimS(text)
+	hits := textutils.Detect(text, textutils.Detectors)
+	textFragments, err := textutils.GenTextFragments(text, keywords, 480, 640, 5)
 
-			if err != nil {
-				break
+	if err != nil {
+		return
+	}
+
+	// select valid fragments, that does not match any of reject rules
+	var validFragments []textutils.Fragment
+	if len(rejectRules) > 0 {
+		validFragments = make([]textutils.Fragment, 0, len(textFragments))
+
+		for _, fragment := range textFragments {
+			matchId := textutils.CheckFragment(text, fragment, rejectRules)
+
+			// if something is mathched, then insert matched fragment in database
+			if matchId != 0 {
+				fragment.Hits = textutils.FragmentHits(fragment, hits)
+				textutils.AnnotateFragment(text, &fragment, internalKeywords)
+				err = dbManager.insertTextFragment(report, fragment, text, matchId)
+				if err != nil {
+					return
+				}
+				CountRejectedFragment(matchId)
+				nFragments++
+			} else {
+				validFragments = append(validFragments, fragment)
 			}
 		}
+	} else {
+		validFragments = textFragments
+	}
+
+	// join valid fragments, that are close to each other
+	// that reduces total amount of fragments
+	validFragments, err = textutils.UnionFragments(validFragments, 640)
+	for _, fragment := range validFragments {
+		fragment.Hits = textutils.FragmentHits(fragment, hits)
+		textutils.AnnotateFragment(text, &fragment, internalKeywords)
+		err = dbManager.insertTextFragment(report, fragment, text, 0)
 
 		if err != nil {
-			errchan <- pError(err)
-			continue
+			return
 		}
-		err = dbManager.UpdateStatus(report.Id, "fragmented")
+		fragmentsCreated.Inc()
+		nFragments++
 	}
+	return
 }
 
-func GitExtractFragments(ctx context.Context, nWorkers int, errchan chan string) (err error) {
-	dbManager := GitDBManager{database.DB}
+func GitExtractFragments(ctx context.Context, nWorkers int) (err error) {
+	dbManager := NewStorage()
+
+	// rules are loaded before the reports are selected, so the selection is always read by workers
+	rejectRules, err := dbManager.GetRules()
+	if err != nil {
+		stageLog(ctx, RunStageExtract).WithError(err).Error("can not load reject rules")
+		return
+	}
 
 	status := "fetched"
-	processingReports, err := dbManager.SelectReportByStatus(status)
+	processingReports, err := dbManager.selectDueReports(ctx, status, JobStageExtract, "")
 	if err != nil {
-		fmt.Printf("%s\n", pError(err))
+		stageLog(ctx, RunStageExtract).WithError(err).Error("can not select reports")
 		return
 	}
 
 	var wg sync.WaitGroup
 	for i := 0; i < nWorkers; i++ {
 		wg.Add(1)
-		go gitExtractionWorker(ctx, i, processingReports, errchan, &wg)
+		go gitExtractionWorker(ctx, i, rejectRules, processingReports, &wg)
 	}
 
 	wg.Wait()
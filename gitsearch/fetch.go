@@ -3,22 +3,18 @@ package gitsearch
 import (
 	"bytes"
 	"context"
-	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"sync"
-	"time"
+	"sync/atomic"
 
-	"../config"
-	"../database"
-	"golang.org/x/time/rate"
+	"github.com/sirupsen/logrus"
 )
 
 func buildFetchRequest(url, token string) (*http.Request, error) {
 	var requestBody bytes.Buffer
 	req, err := http.NewRequest("GET", url, &requestBody)
-	fmt.Println(url)
 
 	if err != nil {
 		return &http.Request{}, err
@@ -30,116 +26,111 @@ func buildFetchRequest(url, token string) (*http.Request, error) {
 	return req, err
 }
 
-func processReportJob(report GitReport, resp *http.Response, errchan chan string, wg *sync.WaitGroup) {
+func processReportJob(ctx context.Context, provider Provider, report GitReport, resp *http.Response, wg *sync.WaitGroup) {
 	defer wg.Done()
-	defer fmt.Println("processReportJob done")
+	log := reportLog(ctx, RunStageFetch, report)
 
 	bodyReader, err := getBodyReader(resp)
 	if err != nil {
-		errchan <- pError(err)
+		failAttempt(log, report, JobStageFetch, err)
 		return
 	}
 
 	defer bodyReader.Close()
 	body, err := ioutil.ReadAll(bodyReader)
-
-	var gitFetchItem GitFetchItem
-	err = json.Unmarshal(body, &gitFetchItem)
 	if err != nil {
-		errchan <- pError(err)
+		failAttempt(log, report, JobStageFetch, err)
 		return
 	}
 
-	var decoded []byte
-	if gitFetchItem.Encoding == "base64" {
-		/* Here is some magick: it seems that json automatically decode base64 encoding... */
-		decoded = gitFetchItem.Content
-
-	} else {
-		err = fmt.Errorf("processReportJob: Unknown encoding: %s", gitFetchItem.Encoding)
-		errchan <- pError(err)
+	decoded, err := provider.parseFetchResponse(body)
+	if err != nil {
+		failAttempt(log, report, JobStageFetch, err)
 		return
 	}
 
-	filePrefix := config.Settings.Globals.ContentDir
-	err = ioutil.WriteFile(filePrefix+report.SearchItem.ShaHash, decoded, 0644)
+	err = writeContentFile(report.SearchItem.ShaHash, decoded)
 	if err != nil {
-		errchan <- pError(err)
+		failAttempt(log, report, JobStageFetch, err)
 		return
 	}
 
-	dbManager := GitDBManager{database.DB}
+	dbManager := NewStorage()
 	err = dbManager.UpdateStatus(report.Id, "fetched")
 
 	if err != nil {
-		errchan <- pError(err)
+		log.WithError(err).Error("can not update report status")
 		return
 	}
 
+	atomic.AddInt64(&runStats(ctx).Files, 1)
+	filesFetched.WithLabelValues(provider.Name()).Inc()
+	bytesDownloaded.WithLabelValues(provider.Name()).Add(float64(len(decoded)))
+	fetchedFileSize.WithLabelValues(provider.Name()).Observe(float64(len(decoded)))
+	log.Debug("file fetched")
+
+	err = completeJob(report, JobStageFetch)
+	if err != nil {
+		log.WithError(err).Error("can not complete job")
+	}
 	return
 }
 
-func gitFetchReportWorker(ctx context.Context, id int, jobchan chan GitReport, errchan chan string, wg *sync.WaitGroup) {
-	fmt.Println("gitFetchReportWorker")
+func gitFetchReportWorker(ctx context.Context, provider Provider, id int, jobchan chan GitReport, wg *sync.WaitGroup) {
 	defer wg.Done()
-	defer fmt.Println("gitFetchReportWorker done")
 
-	rl := rate.NewLimiter(0.5*rate.Every(time.Second), 1)
-	nTokens := len(config.Settings.Github.Tokens)
-	token := config.Settings.Github.Tokens[id%nTokens]
+	pool := fetchPool(provider)
+	log := stageLog(ctx, RunStageFetch).WithFields(logrus.Fields{"provider": provider.Name(), "worker": id})
+	log.Debug("fetch worker started")
 
 	for report := range jobchan {
-		req, _ := buildFetchRequest(report.SearchItem.GitUrl, token)
-
-	MAKE_REQUEST:
-		for {
-			_ = rl.Wait(ctx)
-			resp, err := doRequest(req)
+		buildRequest := func(token string) (*http.Request, error) {
+			return provider.buildFetchRequest(report.SearchItem, token)
+		}
 
-			if err != nil {
-				errchan <- pError(err)
+		resp, err := pool.do(ctx, buildRequest)
+		if err != nil {
+			if ctx.Err() != nil {
 				return
 			}
 
-			if resp.StatusCode == 200 {
-				wg.Add(1)
-				go processReportJob(report, resp, errchan, wg)
-				break MAKE_REQUEST
-
-			} else {
-				resp.Body.Close()
-				<-time.After(10 * time.Second)
-				fmt.Printf("Waiting...\nStatus: %d\n", resp.StatusCode)
-
-				select {
-				case <-ctx.Done():
-					return
-
-				default:
+			// transient network or credential errors are failed attempts, the job is retried later
+			failAttempt(reportLog(ctx, RunStageFetch, report), report, JobStageFetch, err)
+			continue
+		}
 
-				}
-			}
+		// rate limits are already waited out by the pool, any other status is a failed attempt
+		if resp.StatusCode != 200 {
+			resp.Body.Close()
+			err = fmt.Errorf("fetch %s: status %d", report.SearchItem.Url, resp.StatusCode)
+			failAttempt(reportLog(ctx, RunStageFetch, report), report, JobStageFetch, err)
+			continue
 		}
+
+		wg.Add(1)
+		go processReportJob(ctx, provider, report, resp, wg)
 	}
 }
 
-func GitFetch(ctx context.Context, errchan chan string) (err error) {
-	n := len(config.Settings.Github.Tokens)
-	dbManager := GitDBManager{database.DB}
-
+func GitFetch(ctx context.Context) (err error) {
+	dbManager := NewStorage()
 	status := "processing"
-	processingReports, err := dbManager.SelectReportByStatus(status)
-
-	if err != nil {
-		fmt.Printf("%s\n", pError(err))
-		return
-	}
 
 	var wg sync.WaitGroup
 
-	for i := 0; i < n; i++ {
-		wg.Add(1)
-		go gitFetchReportWorker(ctx, i, processingReports, errchan, &wg)
+	for _, provider := range Providers() {
+		n := len(provider.Credentials())
+		processingReports, err := dbManager.selectDueReports(ctx, status, JobStageFetch, provider.Name())
+
+		if err != nil {
+			stageLog(ctx, RunStageFetch).WithError(err).WithField("provider", provider.Name()).Error("can not select reports")
+			continue
+		}
+
+		for i := 0; i < n; i++ {
+			wg.Add(1)
+			go gitFetchReportWorker(ctx, provider, i, processingReports, &wg)
+		}
 	}
 
 	wg.Wait()
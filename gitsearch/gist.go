@@ -0,0 +1,370 @@
+package gitsearch
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"../config"
+
+	"github.com/sirupsen/logrus"
+)
+
+const defaultGistAPIUrl = "https://api.github.com"
+
+// maxGistPages : github does not return more than 3000 public gists
+const maxGistPages = 30
+
+type gistOwner struct {
+	Login   string `json:"login"`
+	HtmlUrl string `json:"html_url"`
+}
+
+type GistFile struct {
+	Filename  string `json:"filename"`
+	Language  string `json:"language"`
+	RawUrl    string `json:"raw_url"`
+	Size      int    `json:"size"`
+	Truncated bool   `json:"truncated"`
+	Content   string `json:"content"`
+}
+
+type GistHistoryItem struct {
+	Version     string `json:"version"`
+	CommittedAt string `json:"committed_at"`
+	Url         string `json:"url"`
+}
+
+type GistItem struct {
+	Id        string              `json:"id"`
+	Url       string              `json:"url"`
+	HtmlUrl   string              `json:"html_url"`
+	Owner     gistOwner           `json:"owner"`
+	Files     map[string]GistFile `json:"files"`
+	History   []GistHistoryItem   `json:"history"`
+	UpdatedAt string              `json:"updated_at"`
+}
+
+type GistJob struct {
+	Id  string
+	Url string
+}
+
+// gistPoll : list of gists (public or of the user), only gists updated since the previous complete poll are listed
+type gistPoll struct {
+	Source   string
+	Since    int64
+	Started  int64
+	Complete bool
+}
+
+func gistAPIUrl() string {
+	if config.Settings.Github.GistAPIUrl != "" {
+		return strings.TrimRight(config.Settings.Github.GistAPIUrl, "/")
+	}
+	return defaultGistAPIUrl
+}
+
+// gitBlobHash : the same hash github uses for blobs, so a file found both in a repo and in a gist is stored once
+func gitBlobHash(content []byte) string {
+	header := fmt.Sprintf("blob %d\x00", len(content))
+	return fmt.Sprintf("%x", sha1.Sum(append([]byte(header), content...)))
+}
+
+func matchKeyword(content string, keywords []string) (keyword string, matched bool) {
+	for _, kw := range keywords {
+		if strings.Contains(content, kw) {
+			return kw, true
+		}
+	}
+	return "", false
+}
+
+func gistGetJSON(ctx context.Context, pool *TokenPool, url string, v interface{}) (err error) {
+	body, err := gistGet(ctx, pool, url)
+	if err != nil {
+		return
+	}
+
+	err = json.Unmarshal(body, v)
+	return
+}
+
+// gistMaxAttempts : server errors and rate limits, that the pool did not wait out, are retried a few times
+const gistMaxAttempts = 3
+
+func gistGet(ctx context.Context, pool *TokenPool, url string) (body []byte, err error) {
+	buildRequest := func(token string) (*http.Request, error) {
+		return buildFetchRequest(url, token)
+	}
+
+	for attempt := 1; ; attempt++ {
+		resp, err := pool.do(ctx, buildRequest)
+		if err != nil {
+			return nil, err
+		}
+
+		if resp.StatusCode == http.StatusOK {
+			bodyReader, err := getBodyReader(resp)
+			if err != nil {
+				return nil, err
+			}
+
+			defer bodyReader.Close()
+			return ioutil.ReadAll(bodyReader)
+		}
+
+		resp.Body.Close()
+		// client errors (401, 403, 404, 451) do not go away on retry, the caller skips the gist
+		if resp.StatusCode >= 400 && resp.StatusCode < 500 && resp.StatusCode != http.StatusTooManyRequests {
+			return nil, fmt.Errorf("gistGet: %s: status %d", url, resp.StatusCode)
+		}
+
+		if attempt >= gistMaxAttempts {
+			return nil, fmt.Errorf("gistGet: %s: status %d after %d attempts", url, resp.StatusCode, attempt)
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(10 * time.Second):
+		}
+	}
+}
+
+func processGistFile(gist GistItem, revision GistHistoryItem, file GistFile, content []byte, keywords []string) (err error) {
+	keyword, matched := matchKeyword(string(content), keywords)
+	if !matched {
+		return
+	}
+
+	dbManager := NewStorage()
+
+	var report GitReport
+	report.Type = ReportTypeGist
+	report.Status = "fetched"
+	report.Query = keyword
+	report.Time = time.Now().Unix()
+	report.SearchItem = GitSearchItem{
+		Name:    file.Filename,
+		Path:    file.Filename,
+		ShaHash: gitBlobHash(content),
+		Url:     revision.Url,
+		GitUrl:  file.RawUrl,
+		HtmlUrl: gist.HtmlUrl + "/" + revision.Version,
+		Repo: gitRepo{
+			Name:     gist.Id,
+			FullName: gist.Owner.Login + "/" + gist.Id,
+			HtmlUrl:  gist.HtmlUrl,
+			Owner:    gitRepoOwner{Login: gist.Owner.Login, Url: gist.Owner.HtmlUrl},
+		},
+	}
+
+	exist, err := dbManager.check(report.SearchItem)
+	if err != nil || exist {
+		return
+	}
+
+	err = writeContentFile(report.SearchItem.ShaHash, content)
+	if err != nil {
+		return
+	}
+
+	err = dbManager.insert(report)
+	return
+}
+
+// gistWorker : failed is set, when a gist or its revision could not be scanned, so the polls are not advanced
+func gistWorker(ctx context.Context, id int, jobchan chan GistJob, failed *int32, wg *sync.WaitGroup) {
+	defer wg.Done()
+	log := stageLog(ctx, RunStageSearch).WithFields(logrus.Fields{"worker": id, "type": ReportTypeGist})
+
+	pool := fetchPool(&GithubProvider{})
+	keywords := config.Settings.Globals.Keywords
+	dbManager := NewStorage()
+
+	for job := range jobchan {
+		var gist GistItem
+		err := gistGetJSON(ctx, pool, job.Url, &gist)
+		if err != nil {
+			log.WithError(err).WithField("gist", job.Id).Error("can not get gist")
+			atomic.StoreInt32(failed, 1)
+			continue
+		}
+		gistLog := log.WithField("gist", gist.Id)
+
+		// every revision of the gist, that was not scanned before, starting from the newest one
+		for _, revision := range gist.History {
+			revisionLog := gistLog.WithField("revision", revision.Version)
+
+			exist, err := dbManager.gistRevisionExist(revision.Version)
+			if err != nil {
+				revisionLog.WithError(err).Error("can not check gist revision")
+				atomic.StoreInt32(failed, 1)
+				continue
+			}
+
+			if exist {
+				continue
+			}
+
+			var revisionGist GistItem
+			err = gistGetJSON(ctx, pool, revision.Url, &revisionGist)
+			if err != nil {
+				revisionLog.WithError(err).Error("can not get gist revision")
+				atomic.StoreInt32(failed, 1)
+				continue
+			}
+
+			// the revision is scanned again, when any of its files fails
+			scanned := true
+			for _, file := range revisionGist.Files {
+				content := []byte(file.Content)
+				if file.Truncated {
+					content, err = gistGet(ctx, pool, file.RawUrl)
+					if err != nil {
+						revisionLog.WithError(err).WithField("file", file.Filename).Error("can not get gist file")
+						scanned = false
+						continue
+					}
+				}
+
+				err = processGistFile(gist, revision, file, content, keywords)
+				if err != nil {
+					revisionLog.WithError(err).WithField("file", file.Filename).Error("can not store gist file")
+					scanned = false
+				}
+			}
+
+			if scanned {
+				err = dbManager.insertGistRevision(gist.Id, revision.Version)
+			}
+
+			if !scanned || err != nil {
+				if err != nil {
+					revisionLog.WithError(err).Error("can not store gist revision")
+				}
+				atomic.StoreInt32(failed, 1)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		default:
+		}
+	}
+}
+
+// gistSources : public gists and gists of the watched users
+func gistSources() (sources []string) {
+	apiUrl := gistAPIUrl()
+
+	sources = []string{apiUrl + "/gists/public"}
+	for _, user := range config.Settings.Github.GistUsers {
+		sources = append(sources, apiUrl+"/users/"+user+"/gists")
+	}
+	return
+}
+
+// genGistJobs : the poll is complete, when all pages of the list are read
+func genGistJobs(ctx context.Context, polls []gistPoll, jobchan chan GistJob, wg *sync.WaitGroup) {
+	defer close(jobchan)
+	defer wg.Done()
+
+	pool := fetchPool(&GithubProvider{})
+
+	seen := make(map[string]bool)
+	for i := range polls {
+		poll := &polls[i]
+		poll.Started = time.Now().Unix()
+
+		for page := 1; page <= maxGistPages; page++ {
+			url := fmt.Sprintf("%s?per_page=100&page=%d", poll.Source, page)
+			if poll.Since > 0 {
+				url += "&since=" + time.Unix(poll.Since, 0).UTC().Format(time.RFC3339)
+			}
+
+			var gists []GistItem
+			err := gistGetJSON(ctx, pool, url, &gists)
+			if err != nil {
+				stageLog(ctx, RunStageSearch).WithError(err).WithField("url", poll.Source).Error("can not list gists")
+				break
+			}
+
+			for _, gist := range gists {
+				if seen[gist.Id] {
+					continue
+				}
+				seen[gist.Id] = true
+
+				select {
+				case jobchan <- GistJob{Id: gist.Id, Url: gist.Url}:
+				case <-ctx.Done():
+					return
+				}
+			}
+
+			if len(gists) < 100 || page == maxGistPages {
+				poll.Complete = true
+				break
+			}
+		}
+	}
+}
+
+// GistSearch : polls public gists and gists of watched users, stores revisions that contain keywords
+func GistSearch(ctx context.Context) (err error) {
+	n := len(githubCredentials())
+	if n == 0 {
+		return fmt.Errorf("GistSearch: no github credentials")
+	}
+
+	dbManager := NewStorage()
+	var polls []gistPoll
+	for _, source := range gistSources() {
+		since, err := dbManager.getGistPoll(source)
+		if err != nil {
+			return err
+		}
+		polls = append(polls, gistPoll{Source: source, Since: since})
+	}
+
+	jobchan := make(chan GistJob, 4096)
+	var wg sync.WaitGroup
+	var failed int32
+
+	wg.Add(1)
+	go genGistJobs(ctx, polls, jobchan, &wg)
+
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go gistWorker(ctx, i, jobchan, &failed, &wg)
+	}
+
+	wg.Wait()
+
+	// gists of the interrupted or failed poll are listed again, their scanned revisions are skipped
+	if ctx.Err() != nil || failed != 0 {
+		return
+	}
+
+	for _, poll := range polls {
+		if !poll.Complete {
+			continue
+		}
+
+		err = dbManager.setGistPoll(poll.Source, poll.Started)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
@@ -0,0 +1,105 @@
+package gitsearch
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"../config"
+)
+
+// fakeGists : public gists with a single gist of two revisions
+type fakeGists struct {
+	*httptest.Server
+	mutex    sync.Mutex
+	since    []string
+	requests []string
+}
+
+func newFakeGists(t *testing.T) *fakeGists {
+	gists := &fakeGists{}
+	mux := http.NewServeMux()
+
+	revision := func(version, content string) GistItem {
+		return GistItem{
+			Id:      "g1",
+			Url:     gists.URL + "/gists/g1/" + version,
+			HtmlUrl: gists.URL + "/g1",
+			Files:   map[string]GistFile{"config.env": {Filename: "config.env", Content: content}},
+		}
+	}
+
+	mux.HandleFunc("/gists/public", func(w http.ResponseWriter, r *http.Request) {
+		gists.mutex.Lock()
+		gists.since = append(gists.since, r.URL.Query().Get("since"))
+		gists.mutex.Unlock()
+		json.NewEncoder(w).Encode([]GistItem{{Id: "g1", Url: gists.URL + "/gists/g1"}})
+	})
+
+	mux.HandleFunc("/gists/g1", func(w http.ResponseWriter, r *http.Request) {
+		gist := revision("", "")
+		gist.History = []GistHistoryItem{{Version: "v2", Url: gists.URL + "/gists/g1/v2"}, {Version: "v1", Url: gists.URL + "/gists/g1/v1"}}
+		json.NewEncoder(w).Encode(gist)
+	})
+
+	mux.HandleFunc("/gists/g1/", func(w http.ResponseWriter, r *http.Request) {
+		gists.mutex.Lock()
+		gists.requests = append(gists.requests, r.URL.Path)
+		gists.mutex.Unlock()
+
+		version := strings.TrimPrefix(r.URL.Path, "/gists/g1/")
+		json.NewEncoder(w).Encode(revision(version, "secret of "+version))
+	})
+
+	gists.Server = httptest.NewServer(mux)
+	return gists
+}
+
+// poll : since parameters of the list requests and sorted revision requests of the search
+func (gists *fakeGists) poll(t *testing.T) (since []string, requests []string) {
+	gists.mutex.Lock()
+	gists.since, gists.requests = nil, nil
+	gists.mutex.Unlock()
+
+	if err := GistSearch(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	gists.mutex.Lock()
+	defer gists.mutex.Unlock()
+	sort.Strings(gists.requests)
+	return gists.since, gists.requests
+}
+
+func TestGistSearch(t *testing.T) {
+	storage := openTestStorage(t, storageBackends()[0])
+	gists := newFakeGists(t)
+	defer gists.Close()
+
+	config.Settings.Github = config.GithubSetting{Tokens: []string{"token"}, GistAPIUrl: gists.URL, FetchRateLimit: 6000}
+	config.Settings.Globals.Keywords = []string{"secret"}
+	config.Settings.Globals.ContentDir = t.TempDir() + "/"
+
+	since, requests := gists.poll(t)
+	if strings.Join(since, " ") != "" || strings.Join(requests, " ") != "/gists/g1/v1 /gists/g1/v2" {
+		t.Fatalf("first poll: since %q, revisions %v", since, requests)
+	}
+
+	// the gist is listed by the update time, the scanned revisions are not downloaded again
+	since, requests = gists.poll(t)
+	if len(since) != 1 || since[0] == "" || len(requests) != 0 {
+		t.Fatalf("second poll: since %q, revisions %v", since, requests)
+	}
+
+	for _, version := range []string{"v1", "v2"} {
+		exist, err := storage.gistRevisionExist(version)
+		if err != nil || !exist {
+			t.Errorf("revision %s is not stored (%v)", version, err)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package gitsearch
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"../config"
+)
+
+// GithubProvider : github code search api
+type GithubProvider struct{}
+
+func (provider *GithubProvider) Name() string {
+	return ReportTypeGithub
+}
+
+// Credentials : personal tokens and github app installations
+func (provider *GithubProvider) Credentials() []Credential {
+	return githubCredentials()
+}
+
+func (provider *GithubProvider) Queries(keywords []string) []string {
+	nKeywords := len(keywords)
+	nQueries := nKeywords * len(config.Settings.Github.Languages)
+	queries := make([]string, nQueries, nQueries)
+
+	for i, lang := range config.Settings.Github.Languages {
+		for j, keyword := range keywords {
+			query := buildGitSearchQuery(keyword, lang, false)
+			queries[i*nKeywords+j] = query
+		}
+	}
+	return queries
+}
+
+func (provider *GithubProvider) MaxPages() int {
+	return 10
+}
+
+func (provider *GithubProvider) Incremental() bool {
+	return true
+}
+
+// RateLimits : search_rate_limit and fetch_rate_limit from config, github defaults when not set
+func (provider *GithubProvider) RateLimits() (search, fetch int) {
+	search, fetch = config.Settings.Github.SearchRateLimit, config.Settings.Github.FetchRateLimit
+	if search <= 0 {
+		search = 30
+	}
+	if fetch <= 0 {
+		fetch = 80
+	}
+	return
+}
+
+func (provider *GithubProvider) buildSearchRequest(query string, page int, token string) (*http.Request, error) {
+	return buildGitSearchRequest(query, page, token)
+}
+
+func (provider *GithubProvider) parseSearchResponse(ctx context.Context, resp *http.Response, body []byte) (githubResponse GitSearchApiResponse, err error) {
+	err = json.Unmarshal(body, &githubResponse)
+	return
+}
+
+func (provider *GithubProvider) buildFetchRequest(item GitSearchItem, token string) (*http.Request, error) {
+	return buildFetchRequest(item.GitUrl, token)
+}
+
+func (provider *GithubProvider) parseFetchResponse(body []byte) (decoded []byte, err error) {
+	var gitFetchItem GitFetchItem
+	err = json.Unmarshal(body, &gitFetchItem)
+	if err != nil {
+		return
+	}
+
+	if gitFetchItem.Encoding == "base64" {
+		/* Here is some magick: it seems that json automatically decode base64 encoding... */
+		decoded = gitFetchItem.Content
+
+	} else {
+		err = fmt.Errorf("processReportJob: Unknown encoding: %s", gitFetchItem.Encoding)
+	}
+	return
+}
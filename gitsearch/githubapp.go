@@ -0,0 +1,204 @@
+package gitsearch
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"../config"
+)
+
+const defaultGithubAPIUrl = "https://api.github.com"
+
+// installation token is refreshed, when it expires in less than that
+const installationTokenRefreshMargin = 5 * time.Minute
+
+// Credential : source of the token, that is put into the Authorization header
+type Credential interface {
+	Token() (string, error)
+}
+
+// StaticToken : personal access token from config
+type StaticToken string
+
+func (token StaticToken) Token() (string, error) {
+	return string(token), nil
+}
+
+func staticTokens(tokens []string) []Credential {
+	credentials := make([]Credential, 0, len(tokens))
+	for _, token := range tokens {
+		credentials = append(credentials, StaticToken(token))
+	}
+	return credentials
+}
+
+// GithubApp : github app installation, the token is exchanged for a JWT signed with the app private key
+type GithubApp struct {
+	setting config.GithubAppSetting
+
+	mutex   sync.Mutex
+	key     *rsa.PrivateKey
+	token   string
+	expires time.Time
+}
+
+type installationToken struct {
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+var githubApps = struct {
+	sync.Mutex
+	apps map[config.GithubAppSetting]*GithubApp
+}{apps: make(map[config.GithubAppSetting]*GithubApp)}
+
+// getGithubApp : one instance per installation, so the token is shared by all pools
+func getGithubApp(setting config.GithubAppSetting) *GithubApp {
+	githubApps.Lock()
+	defer githubApps.Unlock()
+
+	app, exist := githubApps.apps[setting]
+	if !exist {
+		app = &GithubApp{setting: setting}
+		githubApps.apps[setting] = app
+	}
+	return app
+}
+
+func githubCredentials() []Credential {
+	credentials := staticTokens(config.Settings.Github.Tokens)
+	for _, setting := range config.Settings.Github.Apps {
+		credentials = append(credentials, getGithubApp(setting))
+	}
+	return credentials
+}
+
+func parsePrivateKey(data []byte) (key *rsa.PrivateKey, err error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("github app: private key is not PEM encoded")
+	}
+
+	if key, err = x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return
+	}
+
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return
+	}
+
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("github app: private key is not RSA key")
+	}
+	return
+}
+
+func (app *GithubApp) apiUrl() string {
+	if app.setting.ApiUrl != "" {
+		return strings.TrimRight(app.setting.ApiUrl, "/")
+	}
+	return defaultGithubAPIUrl
+}
+
+// jwt : RS256 token, that authenticates the app itself
+func (app *GithubApp) jwt() (string, error) {
+	if app.key == nil {
+		data, err := ioutil.ReadFile(app.setting.PrivateKeyPath)
+		if err != nil {
+			return "", err
+		}
+
+		app.key, err = parsePrivateKey(data)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	now := time.Now()
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	claims, _ := json.Marshal(map[string]interface{}{
+		"iat": now.Add(-time.Minute).Unix(), // clock drift
+		"exp": now.Add(9 * time.Minute).Unix(),
+		"iss": app.setting.AppId,
+	})
+
+	encoding := base64.RawURLEncoding
+	unsigned := encoding.EncodeToString(header) + "." + encoding.EncodeToString(claims)
+	hash := sha256.Sum256([]byte(unsigned))
+
+	signature, err := rsa.SignPKCS1v15(rand.Reader, app.key, crypto.SHA256, hash[:])
+	if err != nil {
+		return "", err
+	}
+	return unsigned + "." + encoding.EncodeToString(signature), nil
+}
+
+func (app *GithubApp) requestInstallationToken() (token installationToken, err error) {
+	jwt, err := app.jwt()
+	if err != nil {
+		return
+	}
+
+	var requestBody bytes.Buffer
+	url := fmt.Sprintf("%s/app/installations/%d/access_tokens", app.apiUrl(), app.setting.InstallationId)
+	req, err := http.NewRequest("POST", url, &requestBody)
+	if err != nil {
+		return
+	}
+
+	req.Header.Set("Authorization", "Bearer "+jwt)
+	req.Header.Set("Accept", "application/vnd.github.v3+json")
+
+	resp, err := doRequest(req)
+	if err != nil {
+		return
+	}
+
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return
+	}
+
+	if resp.StatusCode != http.StatusCreated {
+		err = fmt.Errorf("github app %d: installation %d: status %d: %s", app.setting.AppId, app.setting.InstallationId, resp.StatusCode, body)
+		return
+	}
+
+	err = json.Unmarshal(body, &token)
+	return
+}
+
+// Token : installation access token, it is requested again shortly before it expires
+func (app *GithubApp) Token() (string, error) {
+	app.mutex.Lock()
+	defer app.mutex.Unlock()
+
+	if app.token != "" && time.Until(app.expires) > installationTokenRefreshMargin {
+		return app.token, nil
+	}
+
+	token, err := app.requestInstallationToken()
+	if err != nil {
+		return "", err
+	}
+
+	app.token = token.Token
+	app.expires = token.ExpiresAt
+	return app.token, nil
+}
@@ -0,0 +1,225 @@
+package gitsearch
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+
+	"../config"
+)
+
+type gitlabBlob struct {
+	Id        string `json:"id"`
+	Basename  string `json:"basename"`
+	Data      string `json:"data"`
+	Path      string `json:"path"`
+	Filename  string `json:"filename"`
+	Ref       string `json:"ref"`
+	Startline int    `json:"startline"`
+	ProjectId int    `json:"project_id"`
+}
+
+type gitlabNamespace struct {
+	Path     string `json:"path"`
+	WebUrl   string `json:"web_url"`
+	FullPath string `json:"full_path"`
+}
+
+type gitlabProject struct {
+	Id                int             `json:"id"`
+	Path              string          `json:"path"`
+	PathWithNamespace string          `json:"path_with_namespace"`
+	WebUrl            string          `json:"web_url"`
+	Namespace         gitlabNamespace `json:"namespace"`
+	ForkedFrom        *gitlabProject  `json:"forked_from_project"`
+}
+
+// GitlabProvider : blobs search of a (self-hosted) gitlab instance
+type GitlabProvider struct {
+	setting config.GitlabSetting
+
+	mutex    sync.Mutex
+	projects map[int]gitlabProject
+}
+
+func NewGitlabProvider(setting config.GitlabSetting) *GitlabProvider {
+	setting.Url = strings.TrimRight(setting.Url, "/")
+	return &GitlabProvider{setting: setting, projects: make(map[int]gitlabProject)}
+}
+
+func (provider *GitlabProvider) Name() string {
+	return ReportTypeGitlab
+}
+
+func (provider *GitlabProvider) Credentials() []Credential {
+	return staticTokens(provider.setting.Tokens)
+}
+
+// Queries : gitlab has no language qualifier, so there is one query per keyword
+func (provider *GitlabProvider) Queries(keywords []string) []string {
+	queries := make([]string, len(keywords))
+	copy(queries, keywords)
+	return queries
+}
+
+func (provider *GitlabProvider) MaxPages() int {
+	return 10
+}
+
+// Incremental : blobs search can not be sorted by recency
+func (provider *GitlabProvider) Incremental() bool {
+	return false
+}
+
+func (provider *GitlabProvider) RateLimits() (search, fetch int) {
+	search, fetch = provider.setting.SearchRateLimit, provider.setting.FetchRateLimit
+	if search <= 0 {
+		search = 30
+	}
+	if fetch <= 0 {
+		fetch = 300
+	}
+	return
+}
+
+func (provider *GitlabProvider) apiUrl(endpoint string) string {
+	return provider.setting.Url + "/api/v4" + endpoint
+}
+
+func (provider *GitlabProvider) newRequest(url, token string) (*http.Request, error) {
+	var requestBody bytes.Buffer
+	req, err := http.NewRequest("GET", url, &requestBody)
+
+	if err != nil {
+		return &http.Request{}, err
+	}
+
+	req.Header.Set("PRIVATE-TOKEN", token)
+	req.Header.Set("Accept-Encoding", "deflate, gzip;q=1.0, *;q=0.5")
+	return req, err
+}
+
+func (provider *GitlabProvider) buildSearchRequest(query string, page int, token string) (*http.Request, error) {
+	if page < 1 {
+		page = 1
+	}
+
+	params := url.Values{}
+	params.Set("scope", "blobs")
+	params.Set("search", query)
+	params.Set("per_page", "100")
+	params.Set("page", strconv.Itoa(page))
+
+	return provider.newRequest(provider.apiUrl("/search?"+params.Encode()), token)
+}
+
+// project : project info is not a part of blob search results, so it is requested once per project
+func (provider *GitlabProvider) project(ctx context.Context, projectId int) (project gitlabProject, err error) {
+	provider.mutex.Lock()
+	project, exist := provider.projects[projectId]
+	provider.mutex.Unlock()
+
+	if exist {
+		return
+	}
+
+	projectUrl := provider.apiUrl(fmt.Sprintf("/projects/%d", projectId))
+	resp, err := fetchPool(provider).do(ctx, func(token string) (*http.Request, error) {
+		return provider.newRequest(projectUrl, token)
+	})
+	if err != nil {
+		return
+	}
+
+	bodyReader, err := getBodyReader(resp)
+	if err != nil {
+		return
+	}
+
+	defer bodyReader.Close()
+	if resp.StatusCode != http.StatusOK {
+		err = fmt.Errorf("gitlab: project %d: status %d", projectId, resp.StatusCode)
+		return
+	}
+
+	body, err := ioutil.ReadAll(bodyReader)
+	if err != nil {
+		return
+	}
+
+	err = json.Unmarshal(body, &project)
+	if err != nil {
+		return
+	}
+
+	provider.mutex.Lock()
+	provider.projects[projectId] = project
+	provider.mutex.Unlock()
+	return
+}
+
+func (provider *GitlabProvider) parseSearchResponse(ctx context.Context, resp *http.Response, body []byte) (searchResponse GitSearchApiResponse, err error) {
+	var blobs []gitlabBlob
+	err = json.Unmarshal(body, &blobs)
+	if err != nil {
+		return
+	}
+
+	// gitlab omits X-Total when counting is too expensive, then every page is requested
+	searchResponse.TotalCount, err = strconv.Atoi(resp.Header.Get("X-Total"))
+	if err != nil {
+		searchResponse.TotalCount = provider.MaxPages() * 100
+		err = nil
+	}
+	searchResponse.Items = make([]GitSearchItem, 0, len(blobs))
+
+	for _, blob := range blobs {
+		project, err := provider.project(ctx, blob.ProjectId)
+		if err != nil {
+			// the blob is found again by the next search
+			stageLog(ctx, RunStageSearch).WithError(err).WithField("path", blob.Path).Warn("gitlab: blob is skipped")
+			continue
+		}
+
+		// the hash identifies the file, not the matched snippet, so the file found by several keywords is stored once.
+		// Blob ids are returned by newer gitlab versions only.
+		id := fmt.Sprintf("%s:%d:%s:%s:%s", provider.setting.Url, blob.ProjectId, blob.Ref, blob.Path, blob.Id)
+		rawUrl := provider.apiUrl(fmt.Sprintf("/projects/%d/repository/files/%s/raw?ref=%s",
+			blob.ProjectId, strings.Replace(url.PathEscape(blob.Path), "/", "%2F", -1), url.QueryEscape(blob.Ref)))
+
+		item := GitSearchItem{
+			Name:    path.Base(blob.Path),
+			Path:    blob.Path,
+			ShaHash: fmt.Sprintf("%x", sha1.Sum([]byte(id))),
+			Url:     rawUrl,
+			GitUrl:  rawUrl,
+			HtmlUrl: fmt.Sprintf("%s/-/blob/%s/%s", project.WebUrl, blob.Ref, blob.Path),
+			Repo: gitRepo{
+				Name:     project.Path,
+				FullName: project.PathWithNamespace,
+				HtmlUrl:  project.WebUrl,
+				Owner:    gitRepoOwner{Login: project.Namespace.FullPath, Url: project.Namespace.WebUrl},
+				Fork:     project.ForkedFrom != nil,
+			},
+		}
+		searchResponse.Items = append(searchResponse.Items, item)
+	}
+	return
+}
+
+func (provider *GitlabProvider) buildFetchRequest(item GitSearchItem, token string) (*http.Request, error) {
+	return provider.newRequest(item.GitUrl, token)
+}
+
+func (provider *GitlabProvider) parseFetchResponse(body []byte) ([]byte, error) {
+	return body, nil
+}
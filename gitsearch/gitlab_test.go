@@ -0,0 +1,162 @@
+package gitsearch
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"../config"
+)
+
+const gitlabTestToken = "glpat-test"
+
+// fakeGitlab : blobs search, projects and raw files of a gitlab instance
+func fakeGitlab(t *testing.T, projectRequests *int64) *httptest.Server {
+	var server *httptest.Server
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/api/v4/search", func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		if query.Get("scope") != "blobs" || query.Get("search") != "secret" || r.Header.Get("PRIVATE-TOKEN") != gitlabTestToken {
+			t.Errorf("unexpected search request %s", r.URL)
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+
+		w.Header().Set("X-Total", "4")
+		json.NewEncoder(w).Encode([]gitlabBlob{
+			{Path: "dir/config.go", Ref: "main", ProjectId: 1, Data: "secret = 1"},
+			{Path: "dir/config.go", Ref: "main", ProjectId: 1, Data: "other secret"},
+			{Id: "b10b", Path: "README.md", Ref: "dev", ProjectId: 1, Data: "secret"},
+			{Path: "main.go", Ref: "main", ProjectId: 2, Data: "secret"},
+		})
+	})
+
+	mux.HandleFunc("/api/v4/projects/1", func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(projectRequests, 1)
+		json.NewEncoder(w).Encode(gitlabProject{
+			Id:                1,
+			Path:              "app",
+			PathWithNamespace: "group/app",
+			WebUrl:            server.URL + "/group/app",
+			Namespace:         gitlabNamespace{Path: "group", FullPath: "group", WebUrl: server.URL + "/group"},
+		})
+	})
+
+	// the project is removed after the search
+	mux.HandleFunc("/api/v4/projects/2", func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(projectRequests, 1)
+		http.Error(w, `{"message":"404 Project Not Found"}`, http.StatusNotFound)
+	})
+
+	mux.HandleFunc("/api/v4/projects/1/repository/files/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.EscapedPath() != "/api/v4/projects/1/repository/files/dir%2Fconfig.go/raw" || r.URL.Query().Get("ref") != "main" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte("package dir\n\nconst secret = 1\n"))
+	})
+
+	server = httptest.NewServer(mux)
+	return server
+}
+
+func TestGitlabSearch(t *testing.T) {
+	var projectRequests int64
+	server := fakeGitlab(t, &projectRequests)
+	defer server.Close()
+
+	provider := NewGitlabProvider(config.GitlabSetting{Url: server.URL + "/", Tokens: []string{gitlabTestToken}})
+	ctx := context.Background()
+
+	resp, err := searchPool(provider).do(ctx, func(token string) (*http.Request, error) {
+		return provider.buildSearchRequest("secret", 0, token)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	searchResponse, err := provider.parseSearchResponse(ctx, resp, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if searchResponse.TotalCount != 4 {
+		t.Errorf("total count %d, expected 4", searchResponse.TotalCount)
+	}
+
+	// the blob of the removed project is skipped, the rest of the page is kept
+	if len(searchResponse.Items) != 3 {
+		t.Fatalf("%d items, expected 3: %+v", len(searchResponse.Items), searchResponse.Items)
+	}
+
+	if projectRequests != 2 {
+		t.Errorf("%d project requests, expected one per project", projectRequests)
+	}
+
+	first, second, readme := searchResponse.Items[0], searchResponse.Items[1], searchResponse.Items[2]
+	if first.ShaHash != second.ShaHash {
+		t.Errorf("snippets of the same file have different hashes %s and %s", first.ShaHash, second.ShaHash)
+	}
+
+	if first.ShaHash == readme.ShaHash {
+		t.Errorf("different files have the same hash %s", first.ShaHash)
+	}
+
+	expected := GitSearchItem{
+		Name:    "config.go",
+		Path:    "dir/config.go",
+		ShaHash: first.ShaHash,
+		Url:     server.URL + "/api/v4/projects/1/repository/files/dir%2Fconfig.go/raw?ref=main",
+		GitUrl:  server.URL + "/api/v4/projects/1/repository/files/dir%2Fconfig.go/raw?ref=main",
+		HtmlUrl: server.URL + "/group/app/-/blob/main/dir/config.go",
+		Repo: gitRepo{
+			Name:     "app",
+			FullName: "group/app",
+			HtmlUrl:  server.URL + "/group/app",
+			Owner:    gitRepoOwner{Login: "group", Url: server.URL + "/group"},
+		},
+	}
+	if first != expected {
+		t.Errorf("item %+v, expected %+v", first, expected)
+	}
+
+	req, err := provider.buildFetchRequest(first, gitlabTestToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err = doRequest(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("fetch status %d", resp.StatusCode)
+	}
+
+	body, err = ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	content, err := provider.parseFetchResponse(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(content) != "package dir\n\nconst secret = 1\n" {
+		t.Errorf("content %q", content)
+	}
+}
@@ -2,16 +2,17 @@ package gitsearch
 
 import (
 	"compress/gzip"
-	"fmt"
+	"context"
 	"io"
 	"net/http"
-	"runtime"
 	"time"
 
 	_ "encoding/base64"
 
-	"../database"
-	//"log"
+	"../logger"
+	textutils "../utils"
+
+	"github.com/sirupsen/logrus"
 )
 
 type gitRepoOwner struct {
@@ -22,7 +23,9 @@ type gitRepoOwner struct {
 type gitRepo struct {
 	Name     string       `json:"name"`
 	FullName string       `json:"full_name"`
+	HtmlUrl  string       `json:"html_url"`
 	Owner    gitRepoOwner `json:"owner"`
+	Fork     bool         `json:"fork"`
 }
 
 type GitSearchItem struct {
@@ -53,8 +56,29 @@ type GitReport struct {
 	Query      string
 	Status     string
 	Time       int64
+	Type       string
+	Commit     CommitInfo
+	// History : the report is found by the history scan (github_reports.history), it is not a candidate of the scan itself
+	History bool
+}
+
+// CommitInfo : commit, that introduced the text (history scan only)
+type CommitInfo struct {
+	Sha    string `json:"commit_sha"`
+	Author string `json:"commit_author"`
+	Date   int64  `json:"commit_date"`
 }
 
+// Report source types (github_reports.type)
+const (
+	ReportTypeGithub = "github"
+	ReportTypeGist   = "gist"
+	ReportTypeGitlab = "gitlab"
+)
+
+// ReportStatusHistory : history report, while its fragments are extracted, it is never selected by fetch or extraction
+const ReportStatusHistory = "history"
+
 type GitReportProc struct {
 	ReportId int
 	Keyword  string
@@ -62,8 +86,19 @@ type GitReportProc struct {
 }
 
 type GitSearchJob struct {
-	Query  string
-	Offset int
+	Query       string
+	Offset      int
+	MaxPage     int
+	Incremental bool
+}
+
+// SearchWatermark : newest result of the query seen during the last run
+type SearchWatermark struct {
+	Provider   string
+	Query      string
+	LastSha    string
+	TotalCount int
+	Time       int64
 }
 
 type TextFragment struct {
@@ -73,6 +108,18 @@ type TextFragment struct {
 	ReportId       int    `json:"report_id"`
 	ShaHash        string `json:"shahash"`
 	Id             int    `json:"id"`
+	CommitInfo
+	Detectors  []textutils.DetectorHit `json:"detectors"`
+	Confidence float32                 `json:"confidence"`
+	// InternalIndices : offsets of internal keywords, Priority is the number of distinct internal keywords
+	InternalIndices []int `json:"internal_ids"`
+	Priority        int   `json:"priority"`
+}
+
+// FragmentFilter : optional filter of the web report by the detector hits
+type FragmentFilter struct {
+	Detector      string
+	MinConfidence float32
 }
 
 type RuleWeb struct {
@@ -85,12 +132,18 @@ type RegexpUpdateQuery struct {
 	Test   string `json:"test"`
 }
 
-func pError(err error) (message string) {
-	errMessage := err.Error()
-	_, file, line, _ := runtime.Caller(1)
+// stageLog : log entry of the pipeline stage, errors logged with the run context are counted by the run
+func stageLog(ctx context.Context, stage string) *logrus.Entry {
+	return logger.Log.WithContext(ctx).WithField("stage", stage)
+}
 
-	message = fmt.Sprintf("[ERROR] %s %d :\n%s\n\n", file, line, errMessage)
-	return
+// reportLog : log entry of the stage, annotated with the report
+func reportLog(ctx context.Context, stage string, report GitReport) *logrus.Entry {
+	return stageLog(ctx, stage).WithFields(logrus.Fields{
+		"report_id": report.Id,
+		"keyword":   report.Query,
+		"type":      report.Type,
+	})
 }
 
 func doRequest(req *http.Request) (resp *http.Response, err error) {
@@ -103,7 +156,7 @@ func doRequest(req *http.Request) (resp *http.Response, err error) {
 }
 
 func getBodyReader(resp *http.Response) (bodyReader io.ReadCloser, err error) {
-	fmt.Printf("Encoding: %s\n", resp.Header.Get("Content-Encoding"))
+	logger.Log.WithField("encoding", resp.Header.Get("Content-Encoding")).Debug("reading response body")
 	switch resp.Header.Get("Content-Encoding") {
 	case "gzip":
 		bodyReader, err = gzip.NewReader(resp.Body)
@@ -113,33 +166,53 @@ func getBodyReader(resp *http.Response) (bodyReader io.ReadCloser, err error) {
 	}
 
 	if err != nil {
-		fmt.Println("Ex: %v\n", err)
+		logger.Log.WithError(err).Warn("can not decode response body")
 		resp.Body.Close()
 	}
 
 	return bodyReader, err
 }
 
-func GetGitReports(status string, limit, offset int) (report WebUIResult, err error) {
-	dbManager := GitDBManager{database.DB}
+func GetGitReports(status string, limit, offset int, filter FragmentFilter) (report WebUIResult, err error) {
+	return getWebReports(ReportTypeGithub, status, limit, offset, filter)
+}
+
+// GetGitlabReports : same as GetGitReports, but for reports found on gitlab
+func GetGitlabReports(status string, limit, offset int, filter FragmentFilter) (report WebUIResult, err error) {
+	return getWebReports(ReportTypeGitlab, status, limit, offset, filter)
+}
+
+// GetGistReports : same as GetGitReports, but for reports collected from gists
+func GetGistReports(status string, limit, offset int, filter FragmentFilter) (report WebUIResult, err error) {
+	return getWebReports(ReportTypeGist, status, limit, offset, filter)
+}
+
+func getWebReports(reportType, status string, limit, offset int, filter FragmentFilter) (report WebUIResult, err error) {
+	dbManager := NewStorage()
 
 	if status == "new" {
-		report, err = dbManager.QueryWebReport(limit, offset, "new", 0)
+		report, err = dbManager.QueryWebReport(limit, offset, reportType, "new", 0, filter)
 	} else if status == "closed" {
-		report, err = dbManager.QueryWebReport(limit, offset, "new", 1)
+		report, err = dbManager.QueryWebReport(limit, offset, reportType, "new", 1, filter)
 	}
 
 	if err != nil {
-		fmt.Println(err.Error())
+		logger.Log.WithError(err).WithField("type", reportType).Error("can not query reports")
 		return WebUIResult{}, err
 	}
 
 	return report, err
 }
 
+// triageStatuses : names of the statuses, that fragments are marked with
+var triageStatuses = map[int]string{1: "false", 2: "verified"}
+
 func MarkFragment(fragmentId, status int) (err error) {
-	dbManager := GitDBManager{database.DB}
+	dbManager := NewStorage()
 	err = dbManager.ChangeFragmentStatus(status, fragmentId)
+	if err == nil {
+		triageActions.WithLabelValues(triageStatuses[status]).Inc()
+	}
 
 	reportId, err := dbManager.getFragmentReportId(fragmentId)
 	if err != nil {
@@ -175,7 +248,7 @@ func MarkFragment(fragmentId, status int) (err error) {
 }
 
 func FragmentInfo(fragmentId int) (report GitReport, err error) {
-	dbManager := GitDBManager{database.DB}
+	dbManager := NewStorage()
 	reportId, err := dbManager.getFragmentReportId(fragmentId)
 
 	if err != nil {
@@ -0,0 +1,383 @@
+package gitsearch
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"../config"
+	textutils "../utils"
+
+	"github.com/sirupsen/logrus"
+)
+
+// commitMarker : separates commits in the git log output
+const commitMarker = "\x1ecommit\x1f"
+
+type historyJob struct {
+	Report  GitReport
+	RepoUrl string
+	// GitEnv : config for clone and fetch (authorization header), it is passed in the environment,
+	// so the token is not visible in the command line of the process. It is set right before the scan,
+	// so the installation token does not expire in the queue
+	GitEnv []string
+}
+
+// historyFile : lines added to the file by the commit
+type historyFile struct {
+	commit CommitInfo
+	path   string
+	added  strings.Builder
+}
+
+func historyRepoDir(repoUrl string) string {
+	return filepath.Join(config.Settings.Globals.HistoryDir, fmt.Sprintf("%x", sha1.Sum([]byte(repoUrl))))
+}
+
+func runGit(ctx context.Context, dir string, env []string, args ...string) (output []byte, err error) {
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Dir = dir
+	cmd.Env = append(append(os.Environ(), "GIT_TERMINAL_PROMPT=0"), env...)
+
+	output, err = cmd.Output()
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		err = fmt.Errorf("git: %v: %s", err, exitErr.Stderr)
+	}
+	return
+}
+
+// syncRepo : clones the repo or fetches new commits, returns heads of all branches
+func syncRepo(ctx context.Context, job historyJob, dir string) (heads []string, err error) {
+	if _, err = os.Stat(dir); os.IsNotExist(err) {
+		_, err = runGit(ctx, config.Settings.Globals.HistoryDir, job.GitEnv, "clone", "--bare", "--quiet", job.RepoUrl, dir)
+	} else if err == nil {
+		_, err = runGit(ctx, dir, job.GitEnv, "fetch", "--quiet", "--prune", "origin", "+refs/heads/*:refs/heads/*")
+	}
+
+	if err != nil {
+		return
+	}
+
+	output, err := runGit(ctx, dir, nil, "for-each-ref", "--format=%(objectname)", "refs/heads")
+	if err != nil {
+		return
+	}
+
+	heads = uniqueHeads(strings.Fields(string(output)))
+	return
+}
+
+func uniqueHeads(heads []string) (unique []string) {
+	sort.Strings(heads)
+	for i, head := range heads {
+		if i == 0 || head != heads[i-1] {
+			unique = append(unique, head)
+		}
+	}
+	return
+}
+
+// existingCommits : heads of the previous scan, that are still in the repo (force pushed commits can be pruned)
+func existingCommits(ctx context.Context, dir string, heads []string) (existing []string) {
+	for _, head := range heads {
+		if _, err := runGit(ctx, dir, nil, "cat-file", "-e", head+"^{commit}"); err == nil {
+			existing = append(existing, head)
+		}
+	}
+	return
+}
+
+func commitUrl(report GitReport, sha string) string {
+	if report.Type == ReportTypeGist {
+		return report.SearchItem.Repo.HtmlUrl + "/" + sha
+	}
+	return report.SearchItem.Repo.HtmlUrl + "/commit/" + sha
+}
+
+// gitAuthEnv : repositories are cloned with a valid token of the fetch pool of the provider (personal or installation token),
+// the repository is cloned without a token, when the provider has no valid tokens
+func gitAuthEnv(report GitReport) ([]string, error) {
+	var provider Provider
+	var username string
+
+	switch report.Type {
+	case ReportTypeGitlab:
+		provider, username = NewGitlabProvider(config.Settings.Gitlab), "oauth2"
+	case ReportTypeGithub, ReportTypeGist:
+		provider, username = &GithubProvider{}, "x-access-token"
+	default:
+		return nil, nil
+	}
+
+	token, err := fetchPool(provider).token()
+	if err == errEmptyTokenPool {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	credentials := base64.StdEncoding.EncodeToString([]byte(username + ":" + token))
+	return []string{
+		"GIT_CONFIG_COUNT=1",
+		"GIT_CONFIG_KEY_0=http.extraHeader",
+		"GIT_CONFIG_VALUE_0=Authorization: Basic " + credentials,
+	}, nil
+}
+
+func parseCommitHeader(line string) (commit CommitInfo) {
+	fields := strings.SplitN(strings.TrimPrefix(line, commitMarker), "\x1f", 3)
+	if len(fields) < 3 {
+		return
+	}
+
+	commit.Sha = fields[0]
+	commit.Author = fields[1]
+	commit.Date, _ = strconv.ParseInt(strings.TrimSpace(fields[2]), 10, 64)
+	return
+}
+
+// walkHistory : streams every file diff of the commits of all branches, that are not reachable from the excluded commits
+func walkHistory(ctx context.Context, dir string, exclude []string, handle func(file *historyFile) error) (err error) {
+	args := []string{"log", "-p", "--no-color", "--no-renames", "--format=" + commitMarker + "%H\x1f%an <%ae>\x1f%at", "--all"}
+	if len(exclude) > 0 {
+		args = append(append(args, "--not"), exclude...)
+	}
+
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Dir = dir
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return
+	}
+
+	if err = cmd.Start(); err != nil {
+		return
+	}
+
+	defer func() {
+		// git blocks on the pipe, when the output is not read till the end
+		if err != nil {
+			cmd.Process.Kill()
+		}
+
+		waitErr := cmd.Wait()
+		if err == nil {
+			err = waitErr
+		}
+	}()
+
+	reader := bufio.NewReaderSize(stdout, 64*1024)
+	var commit CommitInfo
+	var file *historyFile
+
+	flush := func() error {
+		if file == nil || file.added.Len() == 0 {
+			return nil
+		}
+		current := file
+		file = nil
+		return handle(current)
+	}
+
+	for {
+		line, readErr := reader.ReadString('\n')
+		line = strings.TrimSuffix(line, "\n")
+
+		switch {
+		case strings.HasPrefix(line, commitMarker):
+			if err = flush(); err != nil {
+				return
+			}
+			commit = parseCommitHeader(line)
+
+		case strings.HasPrefix(line, "diff --git "):
+			if err = flush(); err != nil {
+				return
+			}
+			file = &historyFile{commit: commit}
+
+		case file != nil && strings.HasPrefix(line, "+++ "):
+			file.path = strings.TrimPrefix(strings.TrimPrefix(line, "+++ "), "b/")
+
+		case file != nil && strings.HasPrefix(line, "+"):
+			file.added.WriteString(line[1:])
+			file.added.WriteByte('\n')
+		}
+
+		if readErr == io.EOF {
+			break
+		}
+
+		if readErr != nil {
+			return readErr
+		}
+	}
+
+	return flush()
+}
+
+func scanRepoHistory(ctx context.Context, job historyJob, keywords, internalKeywords []string, rejectRules []textutils.RejectRule) (err error) {
+	dbManager := NewStorage()
+	dir := historyRepoDir(job.RepoUrl)
+
+	job.GitEnv, err = gitAuthEnv(job.Report)
+	if err != nil {
+		return
+	}
+
+	heads, err := syncRepo(ctx, job, dir)
+	if err != nil {
+		return
+	}
+
+	// only commits of any branch after the previous scan
+	lastHeads, err := dbManager.getHistoryHeads(job.RepoUrl)
+	if err != nil {
+		return
+	}
+
+	if strings.Join(lastHeads, " ") == strings.Join(heads, " ") {
+		return
+	}
+
+	err = walkHistory(ctx, dir, existingCommits(ctx, dir, lastHeads), func(file *historyFile) error {
+		text := file.added.String()
+		keyword, matched := matchKeyword(text, keywords)
+		if !matched {
+			return nil
+		}
+
+		report := GitReport{
+			Query:   keyword,
+			Status:  ReportStatusHistory,
+			Time:    time.Now().Unix(),
+			Type:    job.Report.Type,
+			Commit:  file.commit,
+			History: true,
+		}
+
+		report.SearchItem = GitSearchItem{
+			Name:    path.Base(file.path),
+			Path:    file.path,
+			ShaHash: fmt.Sprintf("%x", sha1.Sum([]byte(job.RepoUrl+":"+file.commit.Sha+":"+file.path))),
+			HtmlUrl: commitUrl(job.Report, file.commit.Sha),
+			Repo:    job.Report.SearchItem.Repo,
+		}
+
+		exist, err := dbManager.check(report.SearchItem)
+		if err != nil || exist {
+			return err
+		}
+
+		report.Id, err = dbManager.insertReturningId(report)
+		if err != nil {
+			return err
+		}
+
+		nFragments, err := extractFragments(dbManager, report, text, keywords, internalKeywords, rejectRules)
+		if err == nil {
+			err = dbManager.UpdateStatus(report.Id, "fragmented")
+		}
+
+		// the report is removed, so the file is scanned again, the heads are not advanced after the error
+		if err != nil {
+			deleteErr := dbManager.deleteReport(report.Id)
+			if deleteErr != nil {
+				reportLog(ctx, RunStageExtract, report).WithError(deleteErr).Error("can not remove history report")
+			}
+			return err
+		}
+
+		atomic.AddInt64(&runStats(ctx).Fragments, int64(nFragments))
+		return nil
+	})
+
+	if err != nil {
+		return
+	}
+
+	err = dbManager.setHistoryHeads(job.RepoUrl, heads)
+	return
+}
+
+func historyWorker(ctx context.Context, id int, jobchan chan historyJob, wg *sync.WaitGroup) {
+	defer wg.Done()
+	log := stageLog(ctx, RunStageExtract).WithField("worker", id)
+	keywords := config.Settings.Globals.Keywords
+	internalKeywords := config.Settings.Globals.InternalKeywords
+	dbManager := NewStorage()
+
+	rejectRules, err := dbManager.GetRules()
+	if err != nil {
+		log.WithError(err).Error("can not load rejection rules")
+		return
+	}
+
+	for job := range jobchan {
+		err = scanRepoHistory(ctx, job, keywords, internalKeywords, rejectRules)
+		if err != nil {
+			log.WithError(err).WithFields(logrus.Fields{"report_id": job.Report.Id, "repo": job.RepoUrl}).Error("history scan failed")
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		default:
+		}
+	}
+}
+
+// GitScanHistory : deep scan of the whole commit history of repositories with verified or new findings
+func GitScanHistory(ctx context.Context, nWorkers int) (err error) {
+	if config.Settings.Globals.HistoryDir == "" {
+		return fmt.Errorf("GitScanHistory: history_dir is not set")
+	}
+
+	err = os.MkdirAll(config.Settings.Globals.HistoryDir, 0755)
+	if err != nil {
+		return
+	}
+
+	dbManager := NewStorage()
+	reports, err := dbManager.selectHistoryCandidates()
+	if err != nil {
+		return
+	}
+
+	jobchan := make(chan historyJob, len(reports))
+	seen := make(map[string]bool)
+
+	for _, report := range reports {
+		repoUrl := report.SearchItem.Repo.HtmlUrl
+		if repoUrl == "" || seen[repoUrl] {
+			continue
+		}
+		seen[repoUrl] = true
+		jobchan <- historyJob{Report: report, RepoUrl: repoUrl + ".git"}
+	}
+	close(jobchan)
+
+	var wg sync.WaitGroup
+	for i := 0; i < nWorkers; i++ {
+		wg.Add(1)
+		go historyWorker(ctx, i, jobchan, &wg)
+	}
+
+	wg.Wait()
+	return
+}
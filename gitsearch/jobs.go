@@ -0,0 +1,149 @@
+package gitsearch
+
+import (
+	"fmt"
+	"time"
+
+	"../config"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Job stages, each stage takes reports with the input status
+const (
+	JobStageFetch   = "fetch"
+	JobStageExtract = "extract"
+)
+
+// Job statuses ("failed" is terminal, until the job is requeued)
+const (
+	JobStatusPending = "pending"
+	JobStatusDone    = "done"
+	JobStatusFailed  = "failed"
+)
+
+const (
+	defaultJobMaxAttempts = 5
+	jobBackoffBase        = time.Minute
+	jobBackoffMax         = 24 * time.Hour
+)
+
+// jobStageStatus : status of the report, that is processed by the stage
+var jobStageStatus = map[string]string{
+	JobStageFetch:   "processing",
+	JobStageExtract: "fetched",
+}
+
+// Job : processing attempts of the report at the stage
+type Job struct {
+	Id          int           `json:"id"`
+	ReportId    int           `json:"report_id"`
+	Stage       string        `json:"stage"`
+	Status      string        `json:"status"`
+	Attempts    int           `json:"attempts"`
+	NextAttempt int64         `json:"next_attempt"`
+	LastError   string        `json:"last_error"`
+	Updated     int64         `json:"updated"`
+	Report      GitSearchItem `json:"report"`
+}
+
+func jobMaxAttempts() int {
+	if config.Settings.Globals.JobMaxAttempts > 0 {
+		return config.Settings.Globals.JobMaxAttempts
+	}
+	return defaultJobMaxAttempts
+}
+
+// jobBackoff : delay before the next attempt, doubles after each failure
+func jobBackoff(attempts int) time.Duration {
+	delay := jobBackoffBase
+	for i := 1; i < attempts && delay < jobBackoffMax; i++ {
+		delay *= 2
+	}
+
+	if delay > jobBackoffMax {
+		delay = jobBackoffMax
+	}
+	return delay
+}
+
+// failJob : records the failed attempt, the job becomes "failed" after the last attempt
+func failJob(report GitReport, stage string, jobErr error) (err error) {
+	dbManager := NewStorage()
+
+	job, err := dbManager.recordJobFailure(report.Id, stage, jobErr.Error())
+	if err != nil {
+		return
+	}
+
+	if job.Attempts < jobMaxAttempts() {
+		return dbManager.setJobNextAttempt(job.Id, JobStatusPending, time.Now().Add(jobBackoff(job.Attempts)).Unix())
+	}
+
+	err = dbManager.setJobNextAttempt(job.Id, JobStatusFailed, 0)
+	if err != nil {
+		return
+	}
+	return dbManager.UpdateStatus(report.Id, JobStatusFailed)
+}
+
+// failAttempt : logs the error of the job and records the failed attempt
+func failAttempt(log *logrus.Entry, report GitReport, stage string, jobErr error) {
+	log.WithError(jobErr).Error("job attempt failed")
+
+	err := failJob(report, stage, jobErr)
+	if err != nil {
+		log.WithError(err).Error("can not record failed attempt")
+	}
+}
+
+// completeJob : marks the stage of the report as done
+func completeJob(report GitReport, stage string) error {
+	dbManager := NewStorage()
+	return dbManager.completeJob(report.Id, stage)
+}
+
+// GetJobs : jobs with the status ("" for all)
+func GetJobs(status string, limit, offset int) (jobs []Job, err error) {
+	dbManager := NewStorage()
+	return dbManager.selectJobs(status, limit, offset)
+}
+
+// RequeueJob : resets attempts of the failed job and returns the report to the input status of the stage
+func RequeueJob(jobId int) (err error) {
+	dbManager := NewStorage()
+
+	job, err := dbManager.selectJobById(jobId)
+	if err != nil {
+		return
+	}
+
+	if job.Status != JobStatusFailed {
+		return fmt.Errorf("RequeueJob: job %d is %s", jobId, job.Status)
+	}
+
+	err = dbManager.requeueJob(job.Id)
+	if err != nil {
+		return
+	}
+	return dbManager.UpdateStatus(job.ReportId, jobStageStatus[job.Stage])
+}
+
+// RequeueFailedJobs : requeues all failed jobs, returns the number of requeued jobs
+func RequeueFailedJobs() (n int, err error) {
+	dbManager := NewStorage()
+
+	jobs, err := dbManager.selectJobs(JobStatusFailed, 0, 0)
+	if err != nil {
+		return
+	}
+
+	for _, job := range jobs {
+		err = RequeueJob(job.Id)
+		if err != nil {
+			return
+		}
+		n++
+	}
+	return
+}
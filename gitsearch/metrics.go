@@ -0,0 +1,135 @@
+package gitsearch
+
+import (
+	"net/http"
+	"strconv"
+
+	"../database"
+	"../logger"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const metricsNamespace = "gitsearch"
+
+var (
+	apiRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "api_requests_total",
+		Help:      "Requests to the search and fetch apis by token pool and status code.",
+	}, []string{"pool", "code"})
+
+	apiRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "api_request_duration_seconds",
+		Help:      "Duration of requests to the search and fetch apis by token pool.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"pool"})
+
+	rateLimitWaits = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "rate_limit_waits_total",
+		Help:      "Rate limited responses, after which the token was parked, by token pool and token index.",
+	}, []string{"pool", "token"})
+
+	tokenWaitDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "token_wait_seconds",
+		Help:      "Time spent waiting for a token, that is not rate limited, by token pool.",
+		Buckets:   []float64{0.01, 0.1, 1, 5, 15, 60, 300, 900, 3600},
+	}, []string{"pool"})
+
+	filesFetched = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "files_fetched_total",
+		Help:      "Files fetched by provider.",
+	}, []string{"provider"})
+
+	bytesDownloaded = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "downloaded_bytes_total",
+		Help:      "Size of the fetched files by provider.",
+	}, []string{"provider"})
+
+	fetchedFileSize = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "fetched_file_size_bytes",
+		Help:      "Size distribution of the fetched files by provider.",
+		Buckets:   prometheus.ExponentialBuckets(256, 4, 9),
+	}, []string{"provider"})
+
+	fragmentsCreated = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "fragments_created_total",
+		Help:      "Fragments, that were stored for triage.",
+	})
+
+	fragmentsRejected = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "fragments_rejected_total",
+		Help:      "Fragments, that were rejected automatically, by rejection rule.",
+	}, []string{"rule"})
+
+	triageActions = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "triage_actions_total",
+		Help:      "Fragments marked in the web interface by status.",
+	}, []string{"status"})
+
+	reportQueueDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, "", "reports"),
+		"Reports by status and type, statuses before \"fragmented\" are the queue of the pipeline.",
+		[]string{"status", "type"}, nil,
+	)
+)
+
+// reportQueueCollector : report counts are queried on every scrape, so they are never stale
+type reportQueueCollector struct{}
+
+func (reportQueueCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- reportQueueDesc
+}
+
+func (reportQueueCollector) Collect(ch chan<- prometheus.Metric) {
+	if database.DB == nil {
+		return
+	}
+
+	dbManager := NewStorage()
+	counts, err := dbManager.countReportsByStatus()
+	if err != nil {
+		logger.Log.WithError(err).Error("can not count reports")
+		return
+	}
+
+	for _, count := range counts {
+		ch <- prometheus.MustNewConstMetric(reportQueueDesc, prometheus.GaugeValue, float64(count.Count), count.Status, count.Type)
+	}
+}
+
+func init() {
+	prometheus.MustRegister(
+		apiRequests,
+		apiRequestDuration,
+		rateLimitWaits,
+		tokenWaitDuration,
+		filesFetched,
+		bytesDownloaded,
+		fetchedFileSize,
+		fragmentsCreated,
+		fragmentsRejected,
+		triageActions,
+		reportQueueCollector{},
+	)
+}
+
+// CountRejectedFragment : fragment rejected by the rule on extraction or after the rules are updated
+func CountRejectedFragment(ruleId int) {
+	fragmentsRejected.WithLabelValues(strconv.Itoa(ruleId)).Inc()
+}
+
+// MetricsHandler : metrics in the prometheus format
+func MetricsHandler() http.Handler {
+	return promhttp.Handler()
+}
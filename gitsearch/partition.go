@@ -0,0 +1,200 @@
+package gitsearch
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"../config"
+
+	"github.com/sirupsen/logrus"
+)
+
+// github does not index files larger than 384 KB
+const maxIndexedFileSize = 384 * 1024
+
+// shardProbeInterval : stored leaves are probed again after the interval, the number of results changes slowly
+const shardProbeInterval = 24 * time.Hour
+
+// qualifiers used to split a query, when it can not be split by size anymore
+var defaultPartitionQualifiers = []string{
+	"extension:php", "extension:js", "extension:py", "extension:java", "extension:go",
+	"extension:yml", "extension:json", "extension:xml", "path:config", "filename:.env",
+}
+
+// queryPartitioner : provider, that supports splitting of a query into shards
+type queryPartitioner interface {
+	partitionQualifiers() []string
+}
+
+func (provider *GithubProvider) partitionQualifiers() []string {
+	if len(config.Settings.Github.PartitionBy) > 0 {
+		return config.Settings.Github.PartitionBy
+	}
+	return defaultPartitionQualifiers
+}
+
+// SearchShard : node of the query partition tree, leaves are the queries that are actually searched
+type SearchShard struct {
+	Id         int
+	ParentId   int
+	Provider   string
+	BaseQuery  string
+	Query      string
+	Sized      bool
+	SizeFrom   int
+	SizeTo     int
+	Qualifier  string
+	TotalCount int
+	Leaf       bool
+	// Time : when the shard was probed
+	Time int64
+}
+
+func (shard *SearchShard) buildQuery() string {
+	query := shard.BaseQuery
+	if shard.Sized {
+		query += fmt.Sprintf("+size:%d..%d", shard.SizeFrom, shard.SizeTo)
+	}
+	if shard.Qualifier != "" {
+		query += "+" + shard.Qualifier
+	}
+	return query
+}
+
+func (shard *SearchShard) child(sizeFrom, sizeTo int, qualifier string) SearchShard {
+	child := SearchShard{
+		ParentId:  shard.Id,
+		Provider:  shard.Provider,
+		BaseQuery: shard.BaseQuery,
+		Sized:     true,
+		SizeFrom:  sizeFrom,
+		SizeTo:    sizeTo,
+		Qualifier: qualifier,
+	}
+	child.Query = child.buildQuery()
+	return child
+}
+
+func (shard *SearchShard) canSplit() bool {
+	return !shard.Sized || shard.SizeTo > shard.SizeFrom || shard.Qualifier == ""
+}
+
+// split : halves the size range, when the range is a single size, splits by qualifiers
+// (the last shard contains everything, that does not match any of qualifiers)
+func (shard *SearchShard) split(qualifiers []string) (children []SearchShard) {
+	if !shard.Sized {
+		mid := maxIndexedFileSize / 2
+		return []SearchShard{shard.child(0, mid, shard.Qualifier), shard.child(mid+1, maxIndexedFileSize, shard.Qualifier)}
+	}
+
+	if shard.SizeTo > shard.SizeFrom {
+		mid := (shard.SizeFrom + shard.SizeTo) / 2
+		return []SearchShard{shard.child(shard.SizeFrom, mid, shard.Qualifier), shard.child(mid+1, shard.SizeTo, shard.Qualifier)}
+	}
+
+	negated := make([]string, 0, len(qualifiers))
+	for _, qualifier := range qualifiers {
+		children = append(children, shard.child(shard.SizeFrom, shard.SizeTo, qualifier))
+		negated = append(negated, "-"+qualifier)
+	}
+	children = append(children, shard.child(shard.SizeFrom, shard.SizeTo, strings.Join(negated, "+")))
+	return
+}
+
+// partitionQuery : returns leaf shards of the query, each of them has less results, than the api is able to return.
+// The tree is stored in the database, so the next run reuses the stored leaves and probes only those, that are stale.
+// The shard, that can not be probed, is skipped till the next run.
+func partitionQuery(ctx context.Context, provider Provider, partitioner queryPartitioner, pool *TokenPool, baseQuery string) (leaves []SearchShard, err error) {
+	dbManager := NewStorage()
+	maxCount := provider.MaxPages() * 100
+	qualifiers := partitioner.partitionQualifiers()
+	log := stageLog(ctx, RunStageSearch).WithField("provider", provider.Name())
+
+	stored, err := dbManager.getShardLeaves(provider.Name(), baseQuery)
+	if err != nil {
+		return
+	}
+
+	var queue []SearchShard
+	staleTime := time.Now().Add(-shardProbeInterval).Unix()
+	for _, shard := range stored {
+		if shard.Time < staleTime {
+			queue = append(queue, shard)
+			continue
+		}
+		leaves = append(leaves, shard)
+	}
+
+	if len(stored) == 0 {
+		root := SearchShard{Provider: provider.Name(), BaseQuery: baseQuery, Query: baseQuery, Leaf: true}
+		root.Id, err = dbManager.insertShard(root)
+		if err != nil {
+			return
+		}
+		queue = append(queue, root)
+	}
+
+	for len(queue) > 0 {
+		shard := queue[0]
+		queue = queue[1:]
+
+		select {
+		case <-ctx.Done():
+			return leaves, ctx.Err()
+		default:
+		}
+
+		totalCount, probeErr := probeQuery(ctx, provider, pool, shard.Query)
+		if probeErr != nil {
+			if ctx.Err() != nil {
+				return leaves, ctx.Err()
+			}
+
+			// the stale leaf is searched with the count of the previous probe, the shard, that was never probed, is skipped
+			if shard.Time != 0 {
+				log.WithError(probeErr).WithField("query", shard.Query).Warn("can not probe shard, the previous count is used")
+				leaves = append(leaves, shard)
+				continue
+			}
+
+			log.WithError(probeErr).WithField("query", shard.Query).Warn("can not probe shard, it is skipped")
+			continue
+		}
+		shard.TotalCount = totalCount
+
+		if shard.TotalCount <= maxCount || !shard.canSplit() {
+			if shard.TotalCount > maxCount {
+				log.WithFields(logrus.Fields{
+					"query":       shard.Query,
+					"unavailable": shard.TotalCount - maxCount,
+				}).Warn("shard can not be split")
+			}
+
+			shard.Leaf = true
+			err = dbManager.updateShard(shard)
+			if err != nil {
+				return
+			}
+			leaves = append(leaves, shard)
+			continue
+		}
+
+		shard.Leaf = false
+		err = dbManager.updateShard(shard)
+		if err != nil {
+			return
+		}
+
+		for _, child := range shard.split(qualifiers) {
+			child.Leaf = true
+			child.Id, err = dbManager.insertShard(child)
+			if err != nil {
+				return
+			}
+			queue = append(queue, child)
+		}
+	}
+	return
+}
@@ -0,0 +1,143 @@
+package gitsearch
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"../config"
+)
+
+// fakeGithubSearch : total counts of the queries, the query without a count fails
+type fakeGithubSearch struct {
+	mutex  sync.Mutex
+	counts map[string]int
+	probes []string
+}
+
+func (search *fakeGithubSearch) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	query := strings.Replace(r.URL.Query().Get("q"), " ", "+", -1)
+
+	search.mutex.Lock()
+	search.probes = append(search.probes, query)
+	totalCount, exist := search.counts[query]
+	search.mutex.Unlock()
+
+	if !exist {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	json.NewEncoder(w).Encode(GitSearchApiResponse{TotalCount: totalCount})
+}
+
+// partition : sorted queries of the leaves and the probed queries
+func (search *fakeGithubSearch) partition(t *testing.T, provider *GithubProvider) (leaves []string, probes []string) {
+	search.mutex.Lock()
+	search.probes = nil
+	search.mutex.Unlock()
+
+	shards, err := partitionQuery(context.Background(), provider, provider, searchPool(provider), "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, shard := range shards {
+		leaves = append(leaves, shard.Query)
+	}
+
+	search.mutex.Lock()
+	defer search.mutex.Unlock()
+	return leaves, search.probes
+}
+
+func TestPartitionQuery(t *testing.T) {
+	openTestStorage(t, storageBackends()[0])
+
+	const (
+		lower = "secret+size:0..196608"
+		upper = "secret+size:196609..393216"
+	)
+
+	search := &fakeGithubSearch{counts: map[string]int{"secret": 1500, lower: 800}}
+	server := httptest.NewServer(search)
+	defer server.Close()
+
+	config.Settings.Github.SearchAPIUrl = server.URL + "/search/code?q=%s&page=%d"
+	config.Settings.Github.Tokens = []string{"token"}
+	config.Settings.Github.SearchRateLimit = 6000
+	provider := &GithubProvider{}
+
+	tests := []struct {
+		name   string
+		before func()
+		leaves []string
+		probes []string
+	}{
+		{
+			name:   "the shard, that can not be probed, is skipped",
+			leaves: []string{lower},
+			probes: []string{"secret", lower, upper},
+		},
+		{
+			name: "fresh leaves are reused, the skipped shard is probed",
+			before: func() {
+				search.mutex.Lock()
+				search.counts[upper] = 300
+				search.mutex.Unlock()
+			},
+			leaves: []string{lower, upper},
+			probes: []string{upper},
+		},
+		{
+			name:   "all leaves are fresh",
+			leaves: []string{lower, upper},
+		},
+		{
+			name: "stale leaves are probed",
+			before: func() {
+				_, err := NewStorage().(*SQLiteDBManager).Database.Exec("UPDATE search_shards SET time=1 WHERE query=$1;", lower)
+				if err != nil {
+					t.Fatal(err)
+				}
+			},
+			leaves: []string{upper, lower},
+			probes: []string{lower},
+		},
+		{
+			name: "stale leaf, that can not be probed, is kept",
+			before: func() {
+				search.mutex.Lock()
+				delete(search.counts, upper)
+				search.mutex.Unlock()
+
+				_, err := NewStorage().(*SQLiteDBManager).Database.Exec("UPDATE search_shards SET time=1 WHERE query=$1;", upper)
+				if err != nil {
+					t.Fatal(err)
+				}
+			},
+			leaves: []string{lower, upper},
+			probes: []string{upper},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if test.before != nil {
+				test.before()
+			}
+
+			leaves, probes := search.partition(t, provider)
+			if strings.Join(leaves, " ") != strings.Join(test.leaves, " ") {
+				t.Errorf("leaves %v, expected %v", leaves, test.leaves)
+			}
+
+			if strings.Join(probes, " ") != strings.Join(test.probes, " ") {
+				t.Errorf("probes %v, expected %v", probes, test.probes)
+			}
+		})
+	}
+}
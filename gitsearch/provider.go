@@ -0,0 +1,40 @@
+package gitsearch
+
+import (
+	"context"
+	"net/http"
+
+	"../config"
+)
+
+// Provider : code hosting service, that can be searched for keywords
+type Provider interface {
+	// Name : report type of the results (github_reports.type)
+	Name() string
+	Credentials() []Credential
+	// Queries : search queries for the given keywords
+	Queries(keywords []string) []string
+	// MaxPages : maximum number of pages the search api returns for a single query
+	MaxPages() int
+	// Incremental : results are sorted by recency, so paging may stop at the first known result
+	Incremental() bool
+	// RateLimits : requests per minute for a single token
+	RateLimits() (search, fetch int)
+
+	buildSearchRequest(query string, page int, token string) (*http.Request, error)
+	parseSearchResponse(ctx context.Context, resp *http.Response, body []byte) (GitSearchApiResponse, error)
+	buildFetchRequest(item GitSearchItem, token string) (*http.Request, error)
+	parseFetchResponse(body []byte) ([]byte, error)
+}
+
+// Providers : all configured providers
+func Providers() (providers []Provider) {
+	if len(config.Settings.Github.Tokens) > 0 || len(config.Settings.Github.Apps) > 0 {
+		providers = append(providers, &GithubProvider{})
+	}
+
+	if config.Settings.Gitlab.Url != "" && len(config.Settings.Gitlab.Tokens) > 0 {
+		providers = append(providers, NewGitlabProvider(config.Settings.Gitlab))
+	}
+	return
+}
@@ -0,0 +1,55 @@
+package gitsearch
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"../config"
+)
+
+// suffix of the content file, that is being written
+const partialFileSuffix = ".part"
+
+// writeContentFile : the file is written under temporary name and renamed, so an interrupted write never leaves a truncated file
+func writeContentFile(shaHash string, data []byte) (err error) {
+	fileName := config.Settings.Globals.ContentDir + shaHash
+	partialName := fileName + partialFileSuffix
+
+	err = ioutil.WriteFile(partialName, data, 0644)
+	if err != nil {
+		return
+	}
+
+	err = os.Rename(partialName, fileName)
+	if err != nil {
+		os.Remove(partialName)
+	}
+	return
+}
+
+// RecoverInterruptedWork : rolls back the work, that was interrupted by the previous shutdown.
+// Partial content files are removed, fetched reports lose fragments of the interrupted extraction
+// (they are extracted again), history reports, that were not extracted, are removed (the history is rescanned),
+// runs and schedules left in the running state are marked as interrupted.
+func RecoverInterruptedWork() (err error) {
+	partialFiles, err := filepath.Glob(config.Settings.Globals.ContentDir + "*" + partialFileSuffix)
+	if err != nil {
+		return
+	}
+
+	for _, partialFile := range partialFiles {
+		err = os.Remove(partialFile)
+		if err != nil {
+			return
+		}
+	}
+
+	dbManager := NewStorage()
+	err = dbManager.rollbackInterruptedReports()
+	if err != nil {
+		return
+	}
+
+	return dbManager.markInterruptedRuns()
+}
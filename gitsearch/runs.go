@@ -0,0 +1,288 @@
+package gitsearch
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"../config"
+	"../logger"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Run stages, pipeline is search → fetch → extract
+const (
+	RunStageSearch   = "search"
+	RunStageFetch    = "fetch"
+	RunStageExtract  = "extract"
+	RunStagePipeline = "pipeline"
+)
+
+// Run statuses
+const (
+	RunStatusRunning  = "running"
+	RunStatusDone     = "done"
+	RunStatusFailed   = "failed"
+	RunStatusCanceled = "canceled"
+)
+
+// RunStats : progress counters of the run, they are updated atomically by workers
+type RunStats struct {
+	Queries   int64 `json:"queries"`
+	Pages     int64 `json:"pages"`
+	Files     int64 `json:"files"`
+	Fragments int64 `json:"fragments"`
+	Errors    int64 `json:"errors"`
+}
+
+func (stats *RunStats) snapshot() RunStats {
+	return RunStats{
+		Queries:   atomic.LoadInt64(&stats.Queries),
+		Pages:     atomic.LoadInt64(&stats.Pages),
+		Files:     atomic.LoadInt64(&stats.Files),
+		Fragments: atomic.LoadInt64(&stats.Fragments),
+		Errors:    atomic.LoadInt64(&stats.Errors),
+	}
+}
+
+// Run : manual or scheduled run of the pipeline stage
+type Run struct {
+	Id       int      `json:"id"`
+	Stage    string   `json:"stage"`
+	Keywords []string `json:"keywords"`
+	Trigger  string   `json:"trigger"`
+	Status   string   `json:"status"`
+	Started  int64    `json:"started"`
+	Finished int64    `json:"finished"`
+	Error    string   `json:"error"`
+	RunStats
+
+	// gists : pipeline polls gists too (all keywords are searched)
+	gists  bool
+	cancel context.CancelFunc
+}
+
+type runStatsKey struct{}
+
+// discardStats : counters of the work, that is done outside of any run
+var discardStats RunStats
+
+// runStats : counters of the run, that the context belongs to
+func runStats(ctx context.Context) *RunStats {
+	if stats, ok := ctx.Value(runStatsKey{}).(*RunStats); ok {
+		return stats
+	}
+	return &discardStats
+}
+
+// runErrorHook : counts errors, that are logged with the context of the run
+type runErrorHook struct{}
+
+func (runErrorHook) Levels() []logrus.Level {
+	return []logrus.Level{logrus.PanicLevel, logrus.FatalLevel, logrus.ErrorLevel}
+}
+
+func (runErrorHook) Fire(entry *logrus.Entry) error {
+	if entry.Context != nil {
+		atomic.AddInt64(&runStats(entry.Context).Errors, 1)
+	}
+	return nil
+}
+
+func init() {
+	logger.Log.AddHook(runErrorHook{})
+}
+
+// runner : context of the scheduler, manual runs are started within it
+var runner = struct {
+	sync.Mutex
+	ctx     context.Context
+	current *Run
+}{}
+
+func setRunner(ctx context.Context) {
+	runner.Lock()
+	defer runner.Unlock()
+	runner.ctx = ctx
+}
+
+func runStage(ctx context.Context, run *Run) (err error) {
+	switch run.Stage {
+	case RunStageSearch:
+		return GitSearch(ctx, run.Keywords)
+	case RunStageFetch:
+		return GitFetch(ctx)
+	case RunStageExtract:
+		err = GitExtractFragments(ctx, 2)
+		if err == nil && config.Settings.Globals.HistoryScan {
+			err = GitScanHistory(ctx, 2)
+		}
+		return
+	case RunStagePipeline:
+		return runPipeline(ctx, run.Keywords, run.gists)
+	}
+	return fmt.Errorf("unknown stage %q", run.Stage)
+}
+
+// snapshot : copy of the run with its current counters
+func (run *Run) snapshot() Run {
+	return Run{
+		Id:       run.Id,
+		Stage:    run.Stage,
+		Keywords: run.Keywords,
+		Trigger:  run.Trigger,
+		Status:   run.Status,
+		Started:  run.Started,
+		Finished: run.Finished,
+		Error:    run.Error,
+		RunStats: run.RunStats.snapshot(),
+	}
+}
+
+// beginRun : registers the run as the current one, errors logged with the returned context are counted by the run.
+// The caller holds the pipeline lock.
+func beginRun(ctx context.Context, run *Run) context.Context {
+	dbManager := NewStorage()
+
+	ctx, run.cancel = context.WithCancel(ctx)
+	ctx = context.WithValue(ctx, runStatsKey{}, &run.RunStats)
+
+	run.Status = RunStatusRunning
+	run.Started = time.Now().Unix()
+
+	var err error
+	run.Id, err = dbManager.insertRun(*run)
+	if err != nil {
+		logger.Log.WithError(err).WithField("stage", run.Stage).Error("can not store run")
+	}
+
+	runner.Lock()
+	runner.current = run
+	runner.Unlock()
+	return ctx
+}
+
+// finishRun : stores the result and the counters of the run
+func finishRun(ctx context.Context, run *Run, runErr error) {
+	runner.Lock()
+	runner.current = nil
+	run.Finished = time.Now().Unix()
+	switch {
+	case ctx.Err() == context.Canceled:
+		run.Status = RunStatusCanceled
+	case runErr != nil:
+		run.Status = RunStatusFailed
+		run.Error = runErr.Error()
+	default:
+		run.Status = RunStatusDone
+	}
+	runner.Unlock()
+	run.cancel()
+
+	dbManager := NewStorage()
+	err := dbManager.finishRun(run.Id, run.Status, run.Error, run.Finished, run.RunStats.snapshot())
+	if err != nil {
+		logger.Log.WithError(err).WithFields(logrus.Fields{"run_id": run.Id, "stage": run.Stage}).Error("can not store run result")
+	}
+}
+
+// executeRun : runs the stage synchronously, the caller holds the pipeline lock
+func executeRun(ctx context.Context, run *Run) error {
+	ctx = beginRun(ctx, run)
+	err := runStage(ctx, run)
+	finishRun(ctx, run, err)
+	return err
+}
+
+// StartRun : starts the stage in background, keyword limits the search to a single keyword
+func StartRun(stage, keyword string) (run Run, err error) {
+	switch stage {
+	case RunStageSearch, RunStageFetch, RunStageExtract, RunStagePipeline:
+	default:
+		return run, fmt.Errorf("StartRun: unknown stage %q", stage)
+	}
+
+	runner.Lock()
+	ctx := runner.ctx
+	runner.Unlock()
+
+	if ctx == nil {
+		return run, fmt.Errorf("StartRun: scheduler is not started")
+	}
+
+	started := &Run{Stage: stage, Keywords: config.Settings.Globals.Keywords, Trigger: "manual", gists: true}
+	if keyword != "" {
+		started.Keywords = []string{keyword}
+		started.gists = false
+	}
+
+	if !acquirePipeline() {
+		return run, fmt.Errorf("StartRun: another run is in progress")
+	}
+
+	ctx = beginRun(ctx, started)
+	run = started.snapshot()
+
+	go func() {
+		defer releasePipeline()
+		err := runStage(ctx, started)
+		finishRun(ctx, started, err)
+	}()
+	return
+}
+
+// CurrentRun : the run in progress with its current counters
+func CurrentRun() (run Run, err error) {
+	runner.Lock()
+	defer runner.Unlock()
+
+	if runner.current == nil {
+		return run, fmt.Errorf("no run in progress")
+	}
+
+	return runner.current.snapshot(), nil
+}
+
+// CancelRun : cancels the context of the run in progress
+func CancelRun(runId int) error {
+	runner.Lock()
+	defer runner.Unlock()
+
+	if runner.current == nil || runner.current.Id != runId {
+		return fmt.Errorf("CancelRun: run %d is not in progress", runId)
+	}
+
+	runner.current.cancel()
+	return nil
+}
+
+// LastSearchRun : finish time of the last successful run, that included the search (0 if there is none)
+func LastSearchRun() (finished int64, err error) {
+	dbManager := NewStorage()
+	return dbManager.lastFinishedRun(RunStatusDone, []string{RunStageSearch, RunStagePipeline})
+}
+
+// GetRuns : the current run and the past runs, newest first
+func GetRuns(limit, offset int) (runs []Run, err error) {
+	dbManager := NewStorage()
+	runs, err = dbManager.selectRuns(limit, offset)
+	if err != nil {
+		return
+	}
+
+	current, err := CurrentRun()
+	if err != nil {
+		return runs, nil
+	}
+
+	// counters of the run in progress are not stored till it is finished
+	for i := range runs {
+		if runs[i].Id == current.Id {
+			runs[i] = current
+		}
+	}
+	return
+}
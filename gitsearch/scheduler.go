@@ -0,0 +1,295 @@
+package gitsearch
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"../config"
+	"../logger"
+
+	"github.com/robfig/cron/v3"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultScheduleInterval = time.Hour
+	schedulerTick           = 30 * time.Second
+	defaultScheduleName     = "default"
+	keywordSchedulePrefix   = "keyword:"
+)
+
+// ScheduleRun : persisted state of the schedule
+type ScheduleRun struct {
+	Name     string   `json:"name"`
+	Spec     string   `json:"spec"`
+	Keywords []string `json:"keywords"`
+	LastRun  int64    `json:"last_run"`
+	NextRun  int64    `json:"next_run"`
+	Status   string   `json:"status"`
+	Error    string   `json:"error"`
+	Running  bool     `json:"running"`
+}
+
+type schedule struct {
+	ScheduleRun
+	cron.Schedule
+}
+
+// pipelineLock : only one pipeline run at a time, runs share token pools and report statuses
+var pipelineLock = make(chan struct{}, 1)
+
+func acquirePipeline() bool {
+	select {
+	case pipelineLock <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func releasePipeline() {
+	<-pipelineLock
+}
+
+// waitPipeline : waits for the run in progress, new runs can not be started after that
+func waitPipeline() {
+	pipelineLock <- struct{}{}
+}
+
+// parseScheduleSpec : interval ("30m") or cron expression ("0 */6 * * *", "@daily")
+func parseScheduleSpec(spec string) (cron.Schedule, error) {
+	if interval, err := time.ParseDuration(spec); err == nil {
+		if interval <= 0 {
+			return nil, fmt.Errorf("schedule %q: interval should be positive", spec)
+		}
+		return cron.Every(interval), nil
+	}
+	return cron.ParseStandard(spec)
+}
+
+// invalidSchedule : the schedule with the invalid spec is never run, its keywords are moved to the default schedule
+const invalidSchedule = "invalid"
+
+// configSchedules : default schedule for all keywords without their own schedule, and per-keyword schedules.
+// An invalid spec does not stop the other schedules, the error is reported in the schedule state.
+func configSchedules() (schedules []schedule) {
+	setting := config.Settings.Schedule
+
+	defaultSpec := setting.Cron
+	if defaultSpec == "" {
+		defaultSpec = setting.Interval
+	}
+	if defaultSpec == "" {
+		defaultSpec = defaultScheduleInterval.String()
+	}
+
+	keywords := make([]string, 0, len(setting.Keywords))
+	for keyword := range setting.Keywords {
+		keywords = append(keywords, keyword)
+	}
+	sort.Strings(keywords)
+
+	invalidKeywords := make(map[string]bool)
+	for _, keyword := range keywords {
+		spec := setting.Keywords[keyword]
+		run := ScheduleRun{Name: keywordSchedulePrefix + keyword, Spec: spec, Keywords: []string{keyword}}
+
+		parsed, err := parseScheduleSpec(spec)
+		if err != nil {
+			logger.Log.WithError(err).WithField("schedule", run.Name).Error("invalid schedule, the keyword is searched by the default schedule")
+			invalidKeywords[keyword] = true
+			run.Status = invalidSchedule
+			run.Error = err.Error()
+		}
+		schedules = append(schedules, schedule{run, parsed})
+	}
+
+	var defaultKeywords []string
+	for _, keyword := range config.Settings.Globals.Keywords {
+		if _, exist := setting.Keywords[keyword]; !exist || invalidKeywords[keyword] {
+			defaultKeywords = append(defaultKeywords, keyword)
+		}
+	}
+
+	run := ScheduleRun{Name: defaultScheduleName, Spec: defaultSpec, Keywords: defaultKeywords}
+	parsed, err := parseScheduleSpec(defaultSpec)
+	if err != nil {
+		logger.Log.WithError(err).WithField("schedule", run.Name).Error("invalid schedule, the default interval is used")
+		run.Error = fmt.Sprintf("%v, the default interval %s is used", err, defaultScheduleInterval)
+		parsed = cron.Every(defaultScheduleInterval)
+	}
+
+	schedules = append(schedules, schedule{run, parsed})
+	return
+}
+
+// loadSchedules : schedules from config with the stored last and next run.
+// Schedule, that was never run, is due immediately, the next run is recalculated, when the spec is changed.
+// Nothing is returned, when the runs can not be read, otherwise every schedule would look due.
+func loadSchedules() (schedules []schedule, err error) {
+	dbManager := NewStorage()
+	stored, err := dbManager.selectScheduleRuns()
+	if err != nil {
+		return nil, err
+	}
+
+	schedules = configSchedules()
+
+	now := time.Now()
+	for i := range schedules {
+		if schedules[i].Schedule == nil {
+			continue
+		}
+
+		run, exist := stored[schedules[i].Name]
+		if !exist {
+			schedules[i].NextRun = now.Unix()
+			continue
+		}
+
+		schedules[i].LastRun = run.LastRun
+		schedules[i].Status = run.Status
+		if schedules[i].Error == "" {
+			schedules[i].Error = run.Error
+		}
+		schedules[i].NextRun = run.NextRun
+
+		if run.Spec != schedules[i].Spec {
+			schedules[i].NextRun = schedules[i].Next(time.Unix(run.LastRun, 0)).Unix()
+		}
+	}
+	return
+}
+
+// runPipeline : search → fetch → extract, gists are polled by the default schedule only
+func runPipeline(ctx context.Context, keywords []string, withGists bool) (err error) {
+	if len(keywords) > 0 {
+		err = GitSearch(ctx, keywords)
+		if err != nil {
+			stageLog(ctx, RunStageSearch).WithError(err).Error("search failed")
+		}
+	}
+
+	err = GitFetch(ctx)
+	if err != nil {
+		stageLog(ctx, RunStageFetch).WithError(err).Error("fetch failed")
+	}
+
+	if withGists && len(githubCredentials()) > 0 {
+		err = GistSearch(ctx)
+		if err != nil {
+			stageLog(ctx, RunStageSearch).WithError(err).WithField("type", ReportTypeGist).Error("gist search failed")
+		}
+	}
+
+	err = GitExtractFragments(ctx, 2)
+	if err != nil {
+		stageLog(ctx, RunStageExtract).WithError(err).Error("extraction failed")
+	}
+
+	if config.Settings.Globals.HistoryScan {
+		err = GitScanHistory(ctx, 2)
+		if err != nil {
+			stageLog(ctx, RunStageExtract).WithError(err).Error("history scan failed")
+		}
+	}
+	return ctx.Err()
+}
+
+func runSchedule(ctx context.Context, s *schedule) {
+	dbManager := NewStorage()
+	log := logger.Log.WithFields(logrus.Fields{"schedule": s.Name, "keywords": s.Keywords})
+
+	s.LastRun = time.Now().Unix()
+	s.Status = RunStatusRunning
+	s.Error = ""
+	err := dbManager.saveScheduleRun(s.ScheduleRun)
+	if err != nil {
+		log.WithError(err).Error("can not store schedule")
+	}
+
+	log.Info("scheduled run started")
+	run := &Run{Stage: RunStagePipeline, Keywords: s.Keywords, Trigger: scheduleTrigger(s.Name), gists: s.Name == defaultScheduleName}
+	err = executeRun(ctx, run)
+	s.Status = run.Status
+	s.Error = run.Error
+	if err != nil && s.Error == "" {
+		s.Error = err.Error()
+	}
+
+	// the run interrupted by shutdown is repeated after restart
+	if ctx.Err() != nil {
+		s.Status = "interrupted"
+	} else {
+		s.NextRun = s.Next(time.Now()).Unix()
+	}
+
+	err = dbManager.saveScheduleRun(s.ScheduleRun)
+	if err != nil {
+		log.WithError(err).Error("can not store schedule")
+	}
+	log.WithField("status", s.Status).Info("scheduled run finished")
+}
+
+func scheduleTrigger(name string) string {
+	return "schedule:" + name
+}
+
+// RunScheduler : runs the pipeline for due schedules, config is reloaded on every tick.
+// Returns after the context is canceled and the run in progress (scheduled or manual) is finished.
+func RunScheduler(ctx context.Context) {
+	defer waitPipeline()
+
+	setRunner(ctx)
+	ticker := time.NewTicker(schedulerTick)
+	defer ticker.Stop()
+
+	for {
+		schedules, err := loadSchedules()
+		if err != nil {
+			// nothing is run, the schedules are checked again on the next tick
+			logger.Log.WithError(err).Error("can not load schedules")
+		}
+
+		now := time.Now().Unix()
+		for i := range schedules {
+			if schedules[i].Schedule == nil || schedules[i].NextRun > now || ctx.Err() != nil {
+				continue
+			}
+
+			// the schedule stays due, till the running pipeline is finished
+			if !acquirePipeline() {
+				break
+			}
+
+			runSchedule(ctx, &schedules[i])
+			releasePipeline()
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Schedules : configured schedules with their last and next run
+func Schedules() (runs []ScheduleRun, err error) {
+	schedules, err := loadSchedules()
+	if err != nil {
+		return
+	}
+
+	// zero run, when nothing is running
+	current, _ := CurrentRun()
+
+	runs = make([]ScheduleRun, 0, len(schedules))
+	for _, s := range schedules {
+		s.Running = current.Trigger == scheduleTrigger(s.Name)
+		runs = append(runs, s.ScheduleRun)
+	}
+	return
+}
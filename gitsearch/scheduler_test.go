@@ -0,0 +1,28 @@
+package gitsearch
+
+import (
+	"testing"
+
+	"../config"
+)
+
+func TestLoadSchedulesFailure(t *testing.T) {
+	storage := openTestStorage(t, storageBackends()[0])
+	config.Settings.Globals.Keywords = []string{"secret"}
+
+	schedules, err := loadSchedules()
+	if err != nil || len(schedules) == 0 {
+		t.Fatalf("schedules %+v (%v)", schedules, err)
+	}
+
+	// without the stored runs every schedule would be due on every tick
+	_, err = storage.(*SQLiteDBManager).Database.Exec("DROP TABLE schedules;")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	schedules, err = loadSchedules()
+	if err == nil || schedules != nil {
+		t.Errorf("schedules %+v (%v), expected the error without schedules", schedules, err)
+	}
+}
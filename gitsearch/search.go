@@ -3,16 +3,16 @@ package gitsearch
 import (
 	"bytes"
 	"context"
-	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"../config"
-	"../database"
-	"golang.org/x/time/rate"
+
+	"github.com/sirupsen/logrus"
 )
 
 func buildGitSearchQuery(keyword string, lang string, infile bool) (query string) {
@@ -29,7 +29,8 @@ func buildGitSearchQuery(keyword string, lang string, infile bool) (query string
 func buildGitSearchRequest(query string, offset int, token string) (*http.Request, error) {
 	var requestBody bytes.Buffer
 	url := fmt.Sprintf(config.Settings.Github.SearchAPIUrl, query, offset)
-	fmt.Println(url)
+	// newest results first, so the incremental search can stop at the first known result
+	url += "&sort=indexed&order=desc"
 	req, err := http.NewRequest("GET", url, &requestBody)
 
 	if err != nil {
@@ -43,33 +44,54 @@ func buildGitSearchRequest(query string, offset int, token string) (*http.Reques
 	return req, err
 }
 
-func processSearchResponse(query string, resp *http.Response, errchan chan string, wg *sync.WaitGroup) {
-	fmt.Println("processSearchResponse")
+func processSearchResponse(ctx context.Context, provider Provider, job GitSearchJob, resp *http.Response, wg *sync.WaitGroup) {
 	defer wg.Done()
+	storeSearchResponse(ctx, provider, job, resp)
+}
 
-	dbManager := GitDBManager{database.DB}
-	var githubResponse GitSearchApiResponse
+// storeSearchResponse : inserts new items of the response, returns the parsed response
+func storeSearchResponse(ctx context.Context, provider Provider, job GitSearchJob, resp *http.Response) (githubResponse GitSearchApiResponse, err error) {
+	dbManager := NewStorage()
+	query := job.Query
+	log := stageLog(ctx, RunStageSearch).WithFields(logrus.Fields{"provider": provider.Name(), "keyword": query, "page": job.Offset})
 
 	bodyReader, err := getBodyReader(resp)
 	if err != nil {
-		errchan <- pError(err)
+		log.WithError(err).Error("can not read search response")
 		return
 	}
 
 	defer bodyReader.Close()
 	body, err := ioutil.ReadAll(bodyReader)
+	if err != nil {
+		log.WithError(err).Error("can not read search response")
+		return
+	}
 
-	err = json.Unmarshal(body, &githubResponse)
+	githubResponse, err = provider.parseSearchResponse(ctx, resp, body)
 	if err != nil {
-		errchan <- pError(err)
+		log.WithError(err).Error("can not parse search response")
 		return
 	}
 
+	atomic.AddInt64(&runStats(ctx).Pages, 1)
+	log.WithField("items", len(githubResponse.Items)).Debug("search page received")
+
+	rules := excludeRules(ctx)
 	for _, gihubResponseItem := range githubResponse.Items {
-		exist, err := dbManager.check(gihubResponseItem)
+		if rule, matched := excluded(gihubResponseItem, rules); matched {
+			log.WithFields(logrus.Fields{"exclude": rule.Entry, "path": gihubResponseItem.Path}).Debug("search item excluded")
+			err = dbManager.incrementExcludeHits(rule.Entry)
+			if err != nil {
+				log.WithError(err).Error("can not count exclude hit")
+			}
+			continue
+		}
 
-		if err != nil {
-			errchan <- pError(err)
+		exist, checkError := dbManager.check(gihubResponseItem)
+
+		if checkError != nil {
+			log.WithError(checkError).Error("can not check search item")
 			continue
 		}
 
@@ -82,118 +104,241 @@ func processSearchResponse(query string, resp *http.Response, errchan chan strin
 		githubReport.Status = "processing"
 		githubReport.Query = query
 		githubReport.Time = time.Now().Unix()
+		githubReport.Type = provider.Name()
 
 		inertionError := dbManager.insert(githubReport)
 		if inertionError != nil {
-			errchan <- pError(inertionError)
+			log.WithError(inertionError).Error("can not insert report")
 		}
 	}
+	return
 }
 
-func githubSearchWorker(ctx context.Context, id int, jobchan chan GitSearchJob, errchan chan string, wg *sync.WaitGroup) {
-	defer wg.Done()
-	rl := rate.NewLimiter(0.5*rate.Every(time.Second), 1)
-	nTokens := len(config.Settings.Github.Tokens)
-	token := config.Settings.Github.Tokens[id%nTokens]
+// searchMaxAttempts : server errors and rate limits, that the pool did not wait out, are retried a few times
+const searchMaxAttempts = 3
 
-	for job := range jobchan {
-		fmt.Printf("job %v started\n", job)
-		req, _ := buildGitSearchRequest(job.Query, job.Offset, token)
+// doSearchRequest : makes request until it succeeds, client errors fail at once
+func doSearchRequest(ctx context.Context, pool *TokenPool, buildRequest func(token string) (*http.Request, error)) (resp *http.Response, err error) {
+	for attempt := 1; ; attempt++ {
+		resp, err = pool.do(ctx, buildRequest)
 
-	MAKE_REQUEST:
-		for {
-			_ = rl.Wait(ctx)
-			resp, err := doRequest(req)
+		if err != nil {
+			return
+		}
 
-			if err != nil {
-				errchan <- pError(err)
-				return
-			}
+		if resp.StatusCode == 200 {
+			return
+		}
 
-			if resp.StatusCode == 200 {
-				wg.Add(1)
-				go processSearchResponse(job.Query, resp, errchan, wg)
-				break MAKE_REQUEST
+		resp.Body.Close()
+		// invalid queries (422) and forbidden resources do not go away on retry
+		if resp.StatusCode >= 400 && resp.StatusCode < 500 && resp.StatusCode != http.StatusTooManyRequests {
+			return nil, fmt.Errorf("doSearchRequest: status %d", resp.StatusCode)
+		}
 
-			} else {
-				<-time.After(10 * time.Second)
-				fmt.Printf("Waiting...\nStatus: %d\n", resp.StatusCode)
+		if attempt >= searchMaxAttempts {
+			return nil, fmt.Errorf("doSearchRequest: status %d after %d attempts", resp.StatusCode, attempt)
+		}
 
-				select {
-				case <-ctx.Done():
-					return
-				default:
-				}
-			}
+		stageLog(ctx, RunStageSearch).WithField("status", resp.StatusCode).Warn("search request failed, waiting")
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(10 * time.Second):
 		}
 	}
 }
 
-func genGitSearchJobs(ctx context.Context, keywords []string, jobchan chan GitSearchJob, errchan chan string, wg *sync.WaitGroup) {
-	defer close(jobchan)
+func searchRequestBuilder(provider Provider, job GitSearchJob) func(token string) (*http.Request, error) {
+	return func(token string) (*http.Request, error) {
+		return provider.buildSearchRequest(job.Query, job.Offset, token)
+	}
+}
+
+func githubSearchWorker(ctx context.Context, provider Provider, id int, jobchan chan GitSearchJob, wg *sync.WaitGroup) {
 	defer wg.Done()
+	pool := searchPool(provider)
+	log := stageLog(ctx, RunStageSearch).WithFields(logrus.Fields{"provider": provider.Name(), "worker": id})
 
-	nKeywords := len(keywords)
-	nQueries := nKeywords * len(config.Settings.Github.Languages)
-	queries := make([]string, nQueries, nQueries)
+	for job := range jobchan {
+		log.WithFields(logrus.Fields{"keyword": job.Query, "page": job.Offset, "incremental": job.Incremental}).Debug("search job started")
 
-	for i, lang := range config.Settings.Github.Languages {
-		for j, keyword := range keywords {
-			query := buildGitSearchQuery(keyword, lang, false)
-			queries[i*nKeywords+j] = query
+		if job.Incremental {
+			err := walkQuery(ctx, provider, pool, job)
+			if err != nil {
+				log.WithError(err).WithField("keyword", job.Query).Error("incremental search failed")
+				if ctx.Err() != nil {
+					return
+				}
+			}
+			continue
 		}
-	}
 
-	nResults := make([]int, len(queries), len(queries))
-	nTokens := len(config.Settings.Github.Tokens)
-	rl := rate.NewLimiter(0.5*rate.Every(time.Second), 1)
-
-	for id, query := range queries {
-		token := config.Settings.Github.Tokens[id%nTokens]
-		offset := 0
-		req, err := buildGitSearchRequest(query, offset, token)
+		resp, err := doSearchRequest(ctx, pool, searchRequestBuilder(provider, job))
 
 		if err != nil {
-			errchan <- pError(err)
+			log.WithError(err).WithField("keyword", job.Query).Error("search request failed")
+			if ctx.Err() != nil {
+				return
+			}
 			continue
 		}
 
-		_ = rl.Wait(ctx)
+		wg.Add(1)
+		go processSearchResponse(ctx, provider, job, resp, wg)
+	}
+}
+
+// containsSha : the page contains the result with the sha
+func containsSha(items []GitSearchItem, sha string) bool {
+	if sha == "" {
+		return false
+	}
+
+	for _, item := range items {
+		if item.ShaHash == sha {
+			return true
+		}
+	}
+	return false
+}
 
-		resp, err := doRequest(req)
+// walkQuery : walks pages of the query sorted by recency, until the newest result of the previous walk is reached.
+// The watermark is advanced only after the walk completes, so an interrupted walk is repeated by the next run.
+func walkQuery(ctx context.Context, provider Provider, pool *TokenPool, job GitSearchJob) (err error) {
+	dbManager := NewStorage()
+	previous, _, err := dbManager.getWatermark(provider.Name(), job.Query)
+	if err != nil {
+		return
+	}
 
+	var watermark SearchWatermark
+	for page := 1; page <= job.MaxPage; page++ {
+		job.Offset = page
+		resp, err := doSearchRequest(ctx, pool, searchRequestBuilder(provider, job))
 		if err != nil {
-			errchan <- pError(err)
-			continue
+			return err
 		}
 
-		bodyReader, err := getBodyReader(resp)
+		githubResponse, err := storeSearchResponse(ctx, provider, job, resp)
 		if err != nil {
-			errchan <- pError(err)
-			return
+			return err
+		}
+
+		if page == 1 && len(githubResponse.Items) > 0 {
+			watermark = SearchWatermark{
+				Provider:   provider.Name(),
+				Query:      job.Query,
+				LastSha:    githubResponse.Items[0].ShaHash,
+				TotalCount: githubResponse.TotalCount,
+				Time:       time.Now().Unix(),
+			}
 		}
 
-		defer bodyReader.Close()
-		body, err := ioutil.ReadAll(bodyReader)
+		if containsSha(githubResponse.Items, previous.LastSha) || len(githubResponse.Items) < 100 {
+			break
+		}
+	}
 
-		var githubResponse GitSearchApiResponse
-		err = json.Unmarshal(body, &githubResponse)
-		if err != nil {
-			errchan <- pError(err)
+	if watermark.LastSha == "" {
+		return
+	}
+	return dbManager.setWatermark(watermark)
+}
+
+// probeQuery : requests the first page of the query to get the total number of results
+func probeQuery(ctx context.Context, provider Provider, pool *TokenPool, query string) (totalCount int, err error) {
+	resp, err := pool.do(ctx, searchRequestBuilder(provider, GitSearchJob{Query: query}))
+	if err != nil {
+		return
+	}
+
+	bodyReader, err := getBodyReader(resp)
+	if err != nil {
+		return
+	}
+
+	defer bodyReader.Close()
+	body, err := ioutil.ReadAll(bodyReader)
+	if err != nil {
+		return
+	}
+
+	if resp.StatusCode != 200 {
+		err = fmt.Errorf("probeQuery: %s: status %d", query, resp.StatusCode)
+		return
+	}
+
+	githubResponse, err := provider.parseSearchResponse(ctx, resp, body)
+	if err != nil {
+		return
+	}
+
+	totalCount = githubResponse.TotalCount
+	return
+}
+
+func pageCount(provider Provider, totalCount int) int {
+	maxItemsInResponse := 100
+	maxN := int(totalCount/maxItemsInResponse) + 1
+
+	if maxN > provider.MaxPages() {
+		maxN = provider.MaxPages()
+	}
+	return maxN
+}
+
+func genGitSearchJobs(ctx context.Context, provider Provider, keywords []string, jobchan chan GitSearchJob, wg *sync.WaitGroup) {
+	defer close(jobchan)
+	defer wg.Done()
+
+	queries := provider.Queries(keywords)
+	nResults := make(map[string]int, len(queries))
+	pool := searchPool(provider)
+	partitioner, partitioned := provider.(queryPartitioner)
+	incremental := make(map[string]int, len(queries))
+	log := stageLog(ctx, RunStageSearch).WithField("provider", provider.Name())
+
+	for _, query := range queries {
+		atomic.AddInt64(&runStats(ctx).Queries, 1)
+
+		// queries with more results than the api returns are split into shards
+		if partitioned {
+			shards, err := partitionQuery(ctx, provider, partitioner, pool, query)
+			if err != nil {
+				log.WithError(err).WithField("keyword", query).Error("can not partition query")
+			}
+
+			for _, shard := range shards {
+				if provider.Incremental() {
+					incremental[shard.Query] = pageCount(provider, shard.TotalCount)
+					continue
+				}
+				nResults[shard.Query] = shard.TotalCount
+			}
 			continue
 		}
 
-		nResults[id] = githubResponse.TotalCount
+		// results sorted by recency are walked sequentially until the watermark, they do not need probing
+		if provider.Incremental() {
+			incremental[query] = provider.MaxPages()
+			continue
+		}
+
+		totalCount, err := probeQuery(ctx, provider, pool, query)
+		if err != nil {
+			log.WithError(err).WithField("keyword", query).Error("can not probe query")
+		}
+
+		nResults[query] = totalCount
 	}
 
-	for id, query := range queries {
-		maxItemsInResponse := 100
-		fpMaxCount := nResults[id]
-		maxN := int(fpMaxCount/maxItemsInResponse) + 1
+	for query, maxN := range incremental {
+		jobchan <- GitSearchJob{Query: query, MaxPage: maxN, Incremental: true}
+	}
 
-		if maxN > 10 {
-			maxN = 10
-		}
+	for query, fpMaxCount := range nResults {
+		maxN := pageCount(provider, fpMaxCount)
 
 		for offset := 0; offset <= maxN; offset++ {
 			jobchan <- GitSearchJob{Query: query, Offset: offset}
@@ -201,20 +346,21 @@ func genGitSearchJobs(ctx context.Context, keywords []string, jobchan chan GitSe
 	}
 }
 
-//GitSearch : Main search routine
-func GitSearch(ctx context.Context, errchan chan string) (err error) {
-	n := len(config.Settings.Github.Tokens)
-	jobchan := make(chan GitSearchJob, 4096)
-
-	queries := config.Settings.Globals.Keywords
+//GitSearch : Main search routine, searches keywords on every configured provider
+func GitSearch(ctx context.Context, queries []string) (err error) {
 	var wg sync.WaitGroup
 
-	wg.Add(1)
-	go genGitSearchJobs(ctx, queries, jobchan, errchan, &wg)
+	for _, provider := range Providers() {
+		n := len(provider.Credentials())
+		jobchan := make(chan GitSearchJob, 4096)
 
-	for i := 0; i < n; i++ {
 		wg.Add(1)
-		go githubSearchWorker(ctx, i, jobchan, errchan, &wg)
+		go genGitSearchJobs(ctx, provider, queries, jobchan, &wg)
+
+		for i := 0; i < n; i++ {
+			wg.Add(1)
+			go githubSearchWorker(ctx, provider, i, jobchan, &wg)
+		}
 	}
 
 	wg.Wait()
@@ -0,0 +1,48 @@
+package gitsearch
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+)
+
+// SQLiteDBManager : sqlite storage, it shares queries with GitDBManager except of those, that use jsonb.
+// Placeholders ($1) are rewritten by the database driver, json columns are stored as text.
+type SQLiteDBManager struct {
+	GitDBManager
+}
+
+// sqliteLimit : limit 0 returns all rows, as NULLIF does for postgres
+const sqliteLimit = "CASE WHEN $%d > 0 THEN $%d ELSE -1 END"
+
+func (sqliteDBManager *SQLiteDBManager) QueryWebReport(limit, offset int, reportType, status string, rejectId int, filter FragmentFilter) (webReport WebUIResult, err error) {
+	fragmentFilter := "($%d = '' OR EXISTS (SELECT 1 FROM json_each(CAST(detectors AS TEXT)) WHERE json_extract(value, '$.name') = $%d)) AND confidence >= $%d"
+	return sqliteDBManager.queryWebReport(fragmentFilter, limit, offset, reportType, status, rejectId, filter)
+}
+
+func (sqliteDBManager *SQLiteDBManager) selectDueReports(ctx context.Context, status, stage, reportType string) (results chan GitReport, err error) {
+	return sqliteDBManager.queryDueReports(ctx, fmt.Sprintf(dueReportsQuery, "$3 = ''"), status, stage, reportType)
+}
+
+func (sqliteDBManager *SQLiteDBManager) selectJobs(status string, limit, offset int) (jobs []Job, err error) {
+	query := "SELECT " + jobColumns
+	query += "WHERE ($1 = '' OR j.status=$1) ORDER BY j.updated DESC LIMIT " + fmt.Sprintf(sqliteLimit, 2, 2) + " OFFSET $3;"
+	return sqliteDBManager.queryJobs(query, status, limit, offset)
+}
+
+func (sqliteDBManager *SQLiteDBManager) selectRuns(limit, offset int) (runs []Run, err error) {
+	query := "SELECT " + runColumns + "ORDER BY id DESC LIMIT " + fmt.Sprintf(sqliteLimit, 1, 1) + " OFFSET $2;"
+	return sqliteDBManager.queryRuns(query, limit, offset)
+}
+
+func (sqliteDBManager *SQLiteDBManager) lastFinishedRun(status string, stages []string) (finished int64, err error) {
+	stagesJson, err := json.Marshal(stages)
+	if err != nil {
+		return
+	}
+
+	query := "SELECT COALESCE(MAX(finished), 0) FROM runs WHERE status=$1 AND stage IN (SELECT value FROM json_each($2));"
+	row := sqliteDBManager.Database.QueryRow(query, status, string(stagesJson))
+	err = row.Scan(&finished)
+	return
+}
@@ -0,0 +1,77 @@
+package gitsearch
+
+import (
+	"context"
+
+	"../database"
+	textutils "../utils"
+)
+
+// Storage : reports, fragments and the pipeline state.
+// GitDBManager is the postgres implementation, SQLiteDBManager is the sqlite one.
+type Storage interface {
+	GetRules() (rules []textutils.RejectRule, err error)
+	GetRulesWeb() (rules []RuleWeb, err error)
+	InsertRule(updateQuery RegexpUpdateQuery) (err error)
+	RemoveRule(ruleId int) (err error)
+
+	insert(report GitReport) (err error)
+	insertReturningId(report GitReport) (id int, err error)
+	insertTextFragment(report GitReport, fragment textutils.Fragment, text string, rejectId int) error
+	UpdateStatus(reportId int, status string) error
+	check(item GitSearchItem) (exist bool, err error)
+	SelectReportByStatus(ctx context.Context, status string) (results chan GitReport, err error)
+	selectReportById(id int) (gitReport GitReport, err error)
+	countReportsByStatus() (counts []reportCount, err error)
+	getGistPoll(source string) (pollTime int64, err error)
+	setGistPoll(source string, pollTime int64) (err error)
+	gistRevisionExist(version string) (exist bool, err error)
+	insertGistRevision(gistId, version string) (err error)
+
+	QueryWebReport(limit, offset int, reportType, status string, rejectId int, filter FragmentFilter) (webReport WebUIResult, err error)
+	ChangeFragmentStatus(RejectID, FragmentID int) (err error)
+	GetReportFragmentCount(ReportID, RejectID int) (count int, err error)
+	GetReportFragments(ReportID, RejectID int) (results chan TextFragment, err error)
+	getFragmentReportId(fragmentId int) (reportId int, err error)
+	deleteReportFragments(reportId int) (err error)
+	deleteReport(reportId int) (err error)
+
+	getShardLeaves(provider, baseQuery string) (shards []SearchShard, err error)
+	insertShard(shard SearchShard) (id int, err error)
+	updateShard(shard SearchShard) (err error)
+	setWatermark(watermark SearchWatermark) (err error)
+	getWatermark(provider, searchQuery string) (watermark SearchWatermark, exist bool, err error)
+
+	selectHistoryCandidates() (reports []GitReport, err error)
+	getHistoryHeads(repo string) (heads []string, err error)
+	setHistoryHeads(repo string, heads []string) (err error)
+
+	incrementExcludeHits(entry string) (err error)
+	selectExcludeHits() (hits map[string]ExcludeStat, err error)
+
+	selectDueReports(ctx context.Context, status, stage, reportType string) (results chan GitReport, err error)
+	recordJobFailure(reportId int, stage, lastError string) (job Job, err error)
+	setJobNextAttempt(jobId int, status string, nextAttempt int64) (err error)
+	completeJob(reportId int, stage string) (err error)
+	requeueJob(jobId int) (err error)
+	selectJobById(jobId int) (job Job, err error)
+	selectJobs(status string, limit, offset int) (jobs []Job, err error)
+
+	selectScheduleRuns() (runs map[string]ScheduleRun, err error)
+	saveScheduleRun(run ScheduleRun) (err error)
+	insertRun(run Run) (id int, err error)
+	finishRun(id int, status, runError string, finished int64, stats RunStats) (err error)
+	selectRuns(limit, offset int) (runs []Run, err error)
+	lastFinishedRun(status string, stages []string) (finished int64, err error)
+
+	rollbackInterruptedReports() (err error)
+	markInterruptedRuns() (err error)
+}
+
+// NewStorage : storage of the connected database
+func NewStorage() Storage {
+	if database.Driver == database.DriverSQLite {
+		return &SQLiteDBManager{GitDBManager{database.DB}}
+	}
+	return &GitDBManager{database.DB}
+}
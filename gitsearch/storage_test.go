@@ -0,0 +1,523 @@
+package gitsearch
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"../config"
+	"../database"
+	textutils "../utils"
+)
+
+// storageTestPostgresDSN : postgres is tested only when the dsn is set, every test run creates its own schema and drops it
+const storageTestPostgresDSN = "GITSEARCH_TEST_POSTGRES_DSN"
+
+type storageBackend struct {
+	name    string
+	setting func(t *testing.T) config.DBCredentialsSetting
+}
+
+func sqliteTestSetting(t *testing.T) config.DBCredentialsSetting {
+	return config.DBCredentialsSetting{Driver: database.DriverSQLite, Path: filepath.Join(t.TempDir(), "gitsearch.db")}
+}
+
+// postgresTestSetting : the schema of the test is set by search_path, so the database is not cleaned by hand
+func postgresTestSetting(t *testing.T) config.DBCredentialsSetting {
+	dsn := os.Getenv(storageTestPostgresDSN)
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	schema := fmt.Sprintf("gitsearch_test_%d", time.Now().UnixNano())
+	_, err = db.Exec("CREATE SCHEMA " + schema + ";")
+	if err != nil {
+		db.Close()
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		db.Exec("DROP SCHEMA " + schema + " CASCADE;")
+		db.Close()
+	})
+
+	if strings.Contains(dsn, "://") {
+		dsnUrl, err := url.Parse(dsn)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		params := dsnUrl.Query()
+		params.Set("search_path", schema)
+		dsnUrl.RawQuery = params.Encode()
+		dsn = dsnUrl.String()
+	} else {
+		dsn += " search_path=" + schema
+	}
+	return config.DBCredentialsSetting{Driver: database.DriverPostgres, DSN: dsn, ConnectTimeout: "5s"}
+}
+
+func storageBackends() (backends []storageBackend) {
+	backends = append(backends, storageBackend{name: database.DriverSQLite, setting: sqliteTestSetting})
+	if os.Getenv(storageTestPostgresDSN) != "" {
+		backends = append(backends, storageBackend{name: database.DriverPostgres, setting: postgresTestSetting})
+	}
+	return
+}
+
+// openTestStorage : migrated empty database of the backend
+func openTestStorage(t *testing.T, backend storageBackend) Storage {
+	config.Settings.DBCredentials = backend.setting(t)
+	db, err := database.Connect(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	_, err = database.Migrate(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewStorage()
+}
+
+func insertTestReport(t *testing.T, storage Storage, reportType, status, sha string) GitReport {
+	report := GitReport{
+		Status: status,
+		Query:  "secret",
+		Time:   time.Now().Unix(),
+		Type:   reportType,
+		SearchItem: GitSearchItem{
+			Name:    "config.go",
+			Path:    "dir/config.go",
+			ShaHash: sha,
+			GitUrl:  "https://api.github.com/repos/owner/repo/git/blobs/" + sha,
+			Repo:    gitRepo{FullName: "owner/repo", Owner: gitRepoOwner{Login: "owner"}},
+		},
+	}
+
+	id, err := storage.insertReturningId(report)
+	if err != nil {
+		t.Fatal(err)
+	}
+	report.Id = id
+	return report
+}
+
+func insertTestFragment(t *testing.T, storage Storage, report GitReport, text string, hits ...textutils.DetectorHit) {
+	fragment := textutils.Fragment{Left: 0, Right: len(text), KeywordIndices: []int{0, 6}, Hits: hits}
+	err := storage.insertTextFragment(report, fragment, text, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func countDueReports(t *testing.T, storage Storage, status, stage, reportType string) (n int) {
+	results, err := storage.selectDueReports(context.Background(), status, stage, reportType)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for range results {
+		n++
+	}
+	return
+}
+
+func testMigrations(t *testing.T, storage Storage) {
+	files, err := ioutil.ReadDir(filepath.Join("..", "database", "migrations", database.Driver))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	version, err := database.SchemaVersion(database.DB)
+	if err != nil || version != len(files) {
+		t.Fatalf("schema version %d (%v), expected %d", version, err, len(files))
+	}
+
+	// applied migrations are skipped
+	again, err := database.Migrate(database.DB)
+	if err != nil || again != version {
+		t.Fatalf("second migration: version %d (%v), expected %d", again, err, version)
+	}
+}
+
+func testReports(t *testing.T, storage Storage) {
+	report := insertTestReport(t, storage, "reports", "processing", "aaa1")
+
+	exist, err := storage.check(report.SearchItem)
+	if err != nil || !exist {
+		t.Fatalf("check of the inserted report: %v %v", exist, err)
+	}
+
+	exist, err = storage.check(GitSearchItem{ShaHash: "unknown"})
+	if err != nil || exist {
+		t.Fatalf("check of the unknown item: %v %v", exist, err)
+	}
+
+	stored, err := storage.selectReportById(report.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if stored.Status != "processing" || stored.Query != "secret" || stored.Type != "reports" || stored.SearchItem != report.SearchItem {
+		t.Fatalf("stored report %+v, expected %+v", stored, report)
+	}
+
+	err = storage.UpdateStatus(report.Id, "fetched")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stored, err = storage.selectReportById(report.Id)
+	if err != nil || stored.Status != "fetched" {
+		t.Fatalf("status %q (%v), expected fetched", stored.Status, err)
+	}
+
+	err = storage.deleteReport(report.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exist, err = storage.check(report.SearchItem)
+	if err != nil || exist {
+		t.Fatalf("check of the deleted report: %v %v", exist, err)
+	}
+}
+
+func testWebReportFilters(t *testing.T, storage Storage) {
+	report := insertTestReport(t, storage, "filters", "new", "bbb1")
+	insertTestFragment(t, storage, report, "secret jwt", textutils.DetectorHit{Name: "jwt", Confidence: 0.9, Left: 7, Right: 10})
+	insertTestFragment(t, storage, report, "secret aws", textutils.DetectorHit{Name: "aws", Confidence: 0.4, Left: 7, Right: 10})
+	insertTestFragment(t, storage, report, "secret none")
+
+	tests := []struct {
+		name     string
+		filter   FragmentFilter
+		expected int
+	}{
+		{"no filter", FragmentFilter{}, 3},
+		{"detector", FragmentFilter{Detector: "jwt"}, 1},
+		{"another detector", FragmentFilter{Detector: "aws"}, 1},
+		{"unknown detector", FragmentFilter{Detector: "slack"}, 0},
+		{"confidence", FragmentFilter{MinConfidence: 0.5}, 1},
+		{"detector below confidence", FragmentFilter{Detector: "aws", MinConfidence: 0.5}, 0},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			webReport, err := storage.QueryWebReport(10, 0, "filters", "new", 0, test.filter)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if webReport.TotalCount != test.expected || len(webReport.Fragments) != test.expected {
+				t.Fatalf("total %d, %d fragments, expected %d", webReport.TotalCount, len(webReport.Fragments), test.expected)
+			}
+
+			for _, fragment := range webReport.Fragments {
+				if test.filter.Detector != "" && (len(fragment.Detectors) != 1 || fragment.Detectors[0].Name != test.filter.Detector) {
+					t.Fatalf("fragment %q does not match detector %s", fragment.Text, test.filter.Detector)
+				}
+			}
+		})
+	}
+
+	webReport, err := storage.QueryWebReport(1, 1, "filters", "new", 0, FragmentFilter{})
+	if err != nil || webReport.TotalCount != 3 || len(webReport.Fragments) != 1 {
+		t.Fatalf("page of the report: %+v %v", webReport, err)
+	}
+}
+
+func testJobs(t *testing.T, storage Storage) {
+	report := insertTestReport(t, storage, "jobs", "fetched", "ccc1")
+	if n := countDueReports(t, storage, "fetched", JobStageExtract, "jobs"); n != 1 {
+		t.Fatalf("%d due reports without a job, expected 1", n)
+	}
+
+	job, err := storage.recordJobFailure(report.Id, JobStageExtract, "first")
+	if err != nil || job.Attempts != 1 {
+		t.Fatalf("first failure: %+v %v", job, err)
+	}
+
+	again, err := storage.recordJobFailure(report.Id, JobStageExtract, "second")
+	if err != nil || again.Id != job.Id || again.Attempts != 2 {
+		t.Fatalf("second failure is not counted by the same job: %+v %v", again, err)
+	}
+
+	err = storage.setJobNextAttempt(job.Id, JobStatusPending, time.Now().Add(time.Hour).Unix())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n := countDueReports(t, storage, "fetched", JobStageExtract, "jobs"); n != 0 {
+		t.Fatalf("%d due reports with the attempt in the future, expected 0", n)
+	}
+
+	// another stage of the same report has its own job
+	if n := countDueReports(t, storage, "fetched", JobStageFetch, "jobs"); n != 1 {
+		t.Fatalf("%d due reports of another stage, expected 1", n)
+	}
+
+	err = storage.setJobNextAttempt(job.Id, JobStatusFailed, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	jobs, err := storage.selectJobs(JobStatusFailed, 0, 0)
+	if err != nil || len(jobs) != 1 || jobs[0].Id != job.Id || jobs[0].LastError != "second" || jobs[0].Report.ShaHash != "ccc1" {
+		t.Fatalf("failed jobs: %+v %v", jobs, err)
+	}
+
+	jobs, err = storage.selectJobs(JobStatusPending, 0, 0)
+	if err != nil || len(jobs) != 0 {
+		t.Fatalf("pending jobs: %+v %v", jobs, err)
+	}
+
+	if n := countDueReports(t, storage, "fetched", JobStageExtract, "jobs"); n != 0 {
+		t.Fatalf("%d due reports with the failed job, expected 0", n)
+	}
+
+	err = storage.requeueJob(job.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	job, err = storage.selectJobById(job.Id)
+	if err != nil || job.Status != JobStatusPending || job.Attempts != 0 {
+		t.Fatalf("requeued job: %+v %v", job, err)
+	}
+
+	if n := countDueReports(t, storage, "fetched", JobStageExtract, "jobs"); n != 1 {
+		t.Fatalf("%d due reports with the requeued job, expected 1", n)
+	}
+
+	err = storage.completeJob(report.Id, JobStageExtract)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	job, err = storage.selectJobById(job.Id)
+	if err != nil || job.Status != JobStatusDone {
+		t.Fatalf("completed job: %+v %v", job, err)
+	}
+
+	if n := countDueReports(t, storage, "fetched", JobStageExtract, "jobs"); n != 0 {
+		t.Fatalf("%d due reports with the completed job, expected 0", n)
+	}
+}
+
+func testRuns(t *testing.T, storage Storage) {
+	runs := []struct {
+		stage    string
+		status   string
+		finished int64
+	}{
+		{RunStageSearch, RunStatusDone, 20},
+		{RunStagePipeline, RunStatusFailed, 30},
+		{RunStageFetch, RunStatusDone, 40},
+	}
+
+	var ids []int
+	for _, run := range runs {
+		id, err := storage.insertRun(Run{Stage: run.stage, Keywords: []string{"secret"}, Trigger: "manual", Status: RunStatusRunning, Started: 10})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = storage.finishRun(id, run.status, "", run.finished, RunStats{Queries: 2, Pages: 3})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+
+	stored, err := storage.selectRuns(0, 0)
+	if err != nil || len(stored) != len(runs) {
+		t.Fatalf("runs: %+v %v", stored, err)
+	}
+
+	newest := stored[0]
+	if newest.Id != ids[2] || newest.Stage != RunStageFetch || newest.Finished != 40 || newest.Pages != 3 || len(newest.Keywords) != 1 || newest.Keywords[0] != "secret" {
+		t.Fatalf("newest run %+v", newest)
+	}
+
+	stored, err = storage.selectRuns(1, 1)
+	if err != nil || len(stored) != 1 || stored[0].Id != ids[1] {
+		t.Fatalf("second page of runs: %+v %v", stored, err)
+	}
+
+	tests := []struct {
+		status   string
+		stages   []string
+		expected int64
+	}{
+		{RunStatusDone, []string{RunStageSearch, RunStagePipeline}, 20},
+		{RunStatusFailed, []string{RunStageSearch, RunStagePipeline}, 30},
+		{RunStatusDone, []string{RunStageFetch, RunStageSearch}, 40},
+		{RunStatusDone, []string{RunStageExtract}, 0},
+	}
+
+	for _, test := range tests {
+		finished, err := storage.lastFinishedRun(test.status, test.stages)
+		if err != nil || finished != test.expected {
+			t.Errorf("last %s run of %v finished at %d (%v), expected %d", test.status, test.stages, finished, err, test.expected)
+		}
+	}
+}
+
+// testCanceledSelection : the reader stops before the end of the selection, the rows are released after the cancel
+func testCanceledSelection(t *testing.T, storage Storage) {
+	for i := 0; i < 600; i++ {
+		insertTestReport(t, storage, "canceled", "fetched", fmt.Sprintf("eee%d", i))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	results, err := storage.selectDueReports(ctx, "fetched", JobStageFetch, "canceled")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	<-results
+	cancel()
+
+	// the rest of the selection is not read
+	for deadline := time.Now().Add(5 * time.Second); database.DB.Stats().InUse > 0; {
+		if time.Now().After(deadline) {
+			t.Fatal("connection of the selection is not released after the cancel")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func testHistoryCandidates(t *testing.T, storage Storage) {
+	verified := insertTestReport(t, storage, "candidates", "verified", "eee1")
+	found := insertTestReport(t, storage, "candidates", "new", "eee2")
+	insertTestFragment(t, storage, found, "secret found")
+	insertTestReport(t, storage, "candidates", "new", "eee3")
+
+	// the history report keeps its keyword, it is marked by the column
+	history := GitReport{Status: "fragmented", Query: "secret", Type: "candidates", History: true, SearchItem: GitSearchItem{ShaHash: "eee4"}}
+	id, err := storage.insertReturningId(history)
+	if err != nil {
+		t.Fatal(err)
+	}
+	history.Id = id
+	insertTestFragment(t, storage, history, "secret history")
+
+	reports, err := storage.selectHistoryCandidates()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var ids []int
+	for _, report := range reports {
+		if report.Type == "candidates" {
+			ids = append(ids, report.Id)
+		}
+	}
+	sort.Ints(ids)
+
+	if fmt.Sprint(ids) != fmt.Sprint([]int{verified.Id, found.Id}) {
+		t.Errorf("candidates %v, expected %v", ids, []int{verified.Id, found.Id})
+	}
+}
+
+func testRecovery(t *testing.T, storage Storage) {
+	fetched := insertTestReport(t, storage, "recovery", "fetched", "ddd1")
+	insertTestFragment(t, storage, fetched, "secret partial")
+	history := insertTestReport(t, storage, "recovery", ReportStatusHistory, "ddd2")
+	insertTestFragment(t, storage, history, "secret history")
+	extracted := insertTestReport(t, storage, "recovery", "new", "ddd3")
+	insertTestFragment(t, storage, extracted, "secret extracted")
+
+	runId, err := storage.insertRun(Run{Stage: RunStagePipeline, Trigger: "schedule", Status: RunStatusRunning, Started: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = storage.saveScheduleRun(ScheduleRun{Name: "default", Spec: "@every 1h", Status: RunStatusRunning})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = storage.rollbackInterruptedReports()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = storage.markInterruptedRuns()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// fetched reports are extracted again, so fragments of the interrupted extraction are removed
+	if count, err := storage.GetReportFragmentCount(fetched.Id, 0); err != nil || count != 0 {
+		t.Errorf("%d fragments of the fetched report (%v), expected 0", count, err)
+	}
+
+	if exist, err := storage.check(fetched.SearchItem); err != nil || !exist {
+		t.Errorf("fetched report is removed: %v", err)
+	}
+
+	if exist, err := storage.check(history.SearchItem); err != nil || exist {
+		t.Errorf("history report is kept: %v", err)
+	}
+
+	if count, err := storage.GetReportFragmentCount(extracted.Id, 0); err != nil || count != 1 {
+		t.Errorf("%d fragments of the extracted report (%v), expected 1", count, err)
+	}
+
+	runs, err := storage.selectRuns(0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, run := range runs {
+		if run.Id == runId && (run.Status != "interrupted" || run.Finished == 0) {
+			t.Errorf("interrupted run %+v", run)
+		}
+	}
+
+	schedules, err := storage.selectScheduleRuns()
+	if err != nil || schedules["default"].Status != "interrupted" {
+		t.Errorf("interrupted schedule %+v (%v)", schedules["default"], err)
+	}
+}
+
+// storageTests : cases use their own report types, so they share the database of the backend
+var storageTests = []struct {
+	name string
+	test func(t *testing.T, storage Storage)
+}{
+	{"migrations", testMigrations},
+	{"reports", testReports},
+	{"web report filters", testWebReportFilters},
+	{"jobs", testJobs},
+	{"runs", testRuns},
+	{"canceled selection", testCanceledSelection},
+	{"history candidates", testHistoryCandidates},
+	{"recovery", testRecovery},
+}
+
+func TestStorage(t *testing.T) {
+	for _, backend := range storageBackends() {
+		t.Run(backend.name, func(t *testing.T) {
+			storage := openTestStorage(t, backend)
+			for _, storageTest := range storageTests {
+				t.Run(storageTest.name, func(t *testing.T) {
+					storageTest.test(t, storage)
+				})
+			}
+		})
+	}
+}
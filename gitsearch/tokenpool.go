@@ -0,0 +1,380 @@
+package gitsearch
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"../logger"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/time/rate"
+)
+
+var errEmptyTokenPool = errors.New("token pool is empty")
+
+// parking time of a token, that hit the secondary rate limit without Retry-After header
+const secondaryRateLimitPause = 60 * time.Second
+
+// parking time of a token, that was rejected, it is tried again after the pause (the token may be renewed)
+const invalidTokenPause = 10 * time.Minute
+
+type pooledToken struct {
+	index       int
+	credential  Credential
+	limiter     *rate.Limiter
+	remaining   int // -1: unknown
+	limit       int
+	reset       time.Time
+	parkedUntil time.Time
+	leased      int
+	requests    int
+	rateLimited int
+	// invalid : the last response was 401 or the credential could not produce a token
+	invalid bool
+}
+
+// TokenPool : tokens shared by all workers of one api, every request leases the healthiest token
+type TokenPool struct {
+	Name string
+
+	mutex  sync.Mutex
+	tokens []*pooledToken
+	source []Credential
+}
+
+// TokenQuota : token state, that is exposed through the api (without the token itself)
+type TokenQuota struct {
+	Pool        string `json:"pool"`
+	Index       int    `json:"index"`
+	Remaining   int    `json:"remaining"`
+	Limit       int    `json:"limit"`
+	Reset       int64  `json:"reset"`
+	ParkedUntil int64  `json:"parked_until"`
+	Leased      int    `json:"leased"`
+	Requests    int    `json:"requests"`
+	RateLimited int    `json:"rate_limited"`
+	Invalid     bool   `json:"invalid"`
+}
+
+// NewTokenPool : perMinute limits requests of every single token
+func NewTokenPool(name string, credentials []Credential, perMinute int) *TokenPool {
+	pool := &TokenPool{Name: name, source: credentials}
+	for i, credential := range credentials {
+		pool.tokens = append(pool.tokens, &pooledToken{
+			index:      i,
+			credential: credential,
+			limiter:    rate.NewLimiter(rate.Limit(float64(perMinute)/60), 1),
+			remaining:  -1,
+		})
+	}
+	return pool
+}
+
+var tokenPools = struct {
+	sync.Mutex
+	pools map[string]*TokenPool
+}{pools: make(map[string]*TokenPool)}
+
+// getTokenPool : pools live between runs, so the quota state is not lost; a pool is rebuilt, when tokens are changed
+func getTokenPool(name string, credentials []Credential, perMinute int) *TokenPool {
+	tokenPools.Lock()
+	defer tokenPools.Unlock()
+
+	pool, exist := tokenPools.pools[name]
+	if !exist || !reflect.DeepEqual(pool.source, credentials) {
+		pool = NewTokenPool(name, credentials, perMinute)
+		tokenPools.pools[name] = pool
+	}
+	return pool
+}
+
+func searchPool(provider Provider) *TokenPool {
+	searchLimit, _ := provider.RateLimits()
+	return getTokenPool(provider.Name()+"/search", provider.Credentials(), searchLimit)
+}
+
+func fetchPool(provider Provider) *TokenPool {
+	_, fetchLimit := provider.RateLimits()
+	return getTokenPool(provider.Name()+"/fetch", provider.Credentials(), fetchLimit)
+}
+
+// TokenQuotas : state of all tokens of all pools
+func TokenQuotas() (quotas []TokenQuota) {
+	tokenPools.Lock()
+	names := make([]string, 0, len(tokenPools.pools))
+	for name := range tokenPools.pools {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	pools := make([]*TokenPool, 0, len(names))
+	for _, name := range names {
+		pools = append(pools, tokenPools.pools[name])
+	}
+	tokenPools.Unlock()
+
+	quotas = make([]TokenQuota, 0, 16)
+	for _, pool := range pools {
+		quotas = append(quotas, pool.Quotas()...)
+	}
+	return
+}
+
+// Quotas : state of the pool tokens
+func (pool *TokenPool) Quotas() []TokenQuota {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+
+	quotas := make([]TokenQuota, 0, len(pool.tokens))
+	for _, t := range pool.tokens {
+		quota := TokenQuota{
+			Pool:        pool.Name,
+			Index:       t.index,
+			Remaining:   t.remaining,
+			Limit:       t.limit,
+			Leased:      t.leased,
+			Requests:    t.requests,
+			RateLimited: t.rateLimited,
+			Invalid:     t.invalid,
+		}
+		if !t.reset.IsZero() {
+			quota.Reset = t.reset.Unix()
+		}
+		if !t.parkedUntil.IsZero() {
+			quota.ParkedUntil = t.parkedUntil.Unix()
+		}
+		quotas = append(quotas, quota)
+	}
+	return quotas
+}
+
+// healthier : token with more remaining requests is better, unknown quota is considered full
+func (t *pooledToken) healthier(other *pooledToken) bool {
+	remaining, otherRemaining := t.remaining, other.remaining
+	if remaining < 0 {
+		remaining = int(^uint(0) >> 1)
+	}
+	if otherRemaining < 0 {
+		otherRemaining = int(^uint(0) >> 1)
+	}
+
+	if remaining != otherRemaining {
+		return remaining > otherRemaining
+	}
+	return t.leased < other.leased
+}
+
+// lease : waits for the healthiest token, that is not parked, the pool is empty, when only invalid tokens remain
+func (pool *TokenPool) lease(ctx context.Context) (*pooledToken, error) {
+	for {
+		pool.mutex.Lock()
+		now := time.Now()
+
+		var best *pooledToken
+		var wakeUp time.Time
+
+		for _, t := range pool.tokens {
+			if t.invalid && t.parkedUntil.After(now) {
+				continue
+			}
+
+			if t.parkedUntil.After(now) {
+				if wakeUp.IsZero() || t.parkedUntil.Before(wakeUp) {
+					wakeUp = t.parkedUntil
+				}
+				continue
+			}
+
+			if best == nil || t.healthier(best) {
+				best = t
+			}
+		}
+
+		if best != nil {
+			best.leased++
+			pool.mutex.Unlock()
+
+			if err := best.limiter.Wait(ctx); err != nil {
+				pool.release(best, nil)
+				return nil, err
+			}
+			return best, nil
+		}
+		pool.mutex.Unlock()
+
+		if wakeUp.IsZero() {
+			return nil, errEmptyTokenPool
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(time.Until(wakeUp)):
+		}
+	}
+}
+
+// token : token of the healthiest valid credential for requests outside of the pool (git clone and fetch)
+func (pool *TokenPool) token() (string, error) {
+	pool.mutex.Lock()
+	var best *pooledToken
+	for _, t := range pool.tokens {
+		if !t.invalid && (best == nil || t.healthier(best)) {
+			best = t
+		}
+	}
+	pool.mutex.Unlock()
+
+	if best == nil {
+		return "", errEmptyTokenPool
+	}
+
+	token, err := best.credential.Token()
+	if err != nil {
+		pool.mutex.Lock()
+		best.invalid = true
+		best.parkedUntil = time.Now().Add(invalidTokenPause)
+		pool.mutex.Unlock()
+	}
+	return token, err
+}
+
+// release : updates token quota from the response headers, returns true, when the request hit a rate limit
+func (pool *TokenPool) release(t *pooledToken, resp *http.Response) (rateLimited bool) {
+	if resp != nil {
+		rateLimited = isRateLimited(resp)
+	}
+
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+
+	t.leased--
+	if resp == nil {
+		return
+	}
+	t.requests++
+	t.invalid = resp.StatusCode == http.StatusUnauthorized
+
+	now := time.Now()
+	header := resp.Header
+
+	if t.invalid {
+		t.parkedUntil = now.Add(invalidTokenPause)
+		return
+	}
+
+	if remaining, err := strconv.Atoi(header.Get("X-RateLimit-Remaining")); err == nil {
+		t.remaining = remaining
+	}
+	if limit, err := strconv.Atoi(header.Get("X-RateLimit-Limit")); err == nil {
+		t.limit = limit
+	}
+	if reset, err := strconv.ParseInt(header.Get("X-RateLimit-Reset"), 10, 64); err == nil {
+		t.reset = time.Unix(reset, 0)
+	}
+
+	// primary rate limit: the token is useless until reset
+	if t.remaining == 0 && t.reset.After(now) {
+		t.parkedUntil = t.reset
+	}
+
+	if !rateLimited {
+		return
+	}
+	t.rateLimited++
+
+	// secondary rate limit
+	if retryAfter, err := strconv.Atoi(header.Get("Retry-After")); err == nil {
+		t.parkedUntil = now.Add(time.Duration(retryAfter) * time.Second)
+	} else if !t.parkedUntil.After(now) {
+		t.parkedUntil = now.Add(secondaryRateLimitPause)
+	}
+	return
+}
+
+// isRateLimited : 403 is also returned for forbidden resources, rate limit responses are distinguished by headers or message
+func isRateLimited(resp *http.Response) bool {
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests:
+		return true
+
+	case http.StatusForbidden:
+		if resp.Header.Get("X-RateLimit-Remaining") == "0" || resp.Header.Get("Retry-After") != "" {
+			return true
+		}
+
+		// the body is read and put back, so the caller still can read it
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+		if err != nil {
+			return false
+		}
+
+		if resp.Header.Get("Content-Encoding") == "gzip" {
+			gzipReader, err := gzip.NewReader(bytes.NewReader(body))
+			if err != nil {
+				return false
+			}
+			body, _ = ioutil.ReadAll(gzipReader)
+		}
+		return bytes.Contains(bytes.ToLower(body), []byte("rate limit"))
+	}
+	return false
+}
+
+// do : makes request with a leased token, requests that hit rate limit are repeated with another token
+func (pool *TokenPool) do(ctx context.Context, buildRequest func(token string) (*http.Request, error)) (resp *http.Response, err error) {
+	for {
+		leased := time.Now()
+		t, err := pool.lease(ctx)
+		if err != nil {
+			return nil, err
+		}
+		tokenWaitDuration.WithLabelValues(pool.Name).Observe(time.Since(leased).Seconds())
+
+		token, err := t.credential.Token()
+		if err != nil {
+			pool.mutex.Lock()
+			t.invalid = true
+			t.parkedUntil = time.Now().Add(invalidTokenPause)
+			pool.mutex.Unlock()
+
+			pool.release(t, nil)
+			return nil, err
+		}
+
+		req, err := buildRequest(token)
+		if err != nil {
+			pool.release(t, nil)
+			return nil, err
+		}
+
+		started := time.Now()
+		resp, err = doRequest(req.WithContext(ctx))
+		if err != nil {
+			apiRequests.WithLabelValues(pool.Name, "error").Inc()
+			pool.release(t, nil)
+			return nil, err
+		}
+		apiRequests.WithLabelValues(pool.Name, strconv.Itoa(resp.StatusCode)).Inc()
+		apiRequestDuration.WithLabelValues(pool.Name).Observe(time.Since(started).Seconds())
+
+		if pool.release(t, resp) {
+			rateLimitWaits.WithLabelValues(pool.Name, strconv.Itoa(t.index)).Inc()
+			logger.Log.WithContext(ctx).WithFields(logrus.Fields{"pool": pool.Name, "token": t.index}).Warn("token is rate limited, request is retried")
+			resp.Body.Close()
+			continue
+		}
+		return resp, nil
+	}
+}
@@ -0,0 +1,109 @@
+package gitsearch
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestInvalidTokens(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "token valid" {
+			http.Error(w, "bad credentials", http.StatusUnauthorized)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	buildRequest := func(token string) (*http.Request, error) {
+		req, err := http.NewRequest("GET", server.URL, nil)
+		if err == nil {
+			req.Header.Set("Authorization", "token "+token)
+		}
+		return req, err
+	}
+
+	request := func(pool *TokenPool) (int, error) {
+		resp, err := pool.do(context.Background(), buildRequest)
+		if err != nil {
+			return 0, err
+		}
+		resp.Body.Close()
+		return resp.StatusCode, nil
+	}
+
+	pool := NewTokenPool("test", staticTokens([]string{"revoked", "valid"}), 6000)
+	// the revoked token has the largest quota, it is leased first
+	pool.tokens[1].remaining = 10
+
+	for i, expected := range []int{http.StatusUnauthorized, http.StatusOK, http.StatusOK} {
+		status, err := request(pool)
+		if err != nil || status != expected {
+			t.Fatalf("request %d: status %d (%v), expected %d", i, status, err, expected)
+		}
+	}
+
+	pool = NewTokenPool("test", staticTokens([]string{"revoked"}), 6000)
+	if status, err := request(pool); err != nil || status != http.StatusUnauthorized {
+		t.Fatalf("status %d (%v), expected 401", status, err)
+	}
+
+	if _, err := request(pool); err != errEmptyTokenPool {
+		t.Fatalf("request with only invalid tokens: %v, expected %v", err, errEmptyTokenPool)
+	}
+}
+
+func TestDoSearchRequest(t *testing.T) {
+	tests := []struct {
+		name     string
+		status   int
+		requests int64
+	}{
+		{"invalid query fails at once", http.StatusUnprocessableEntity, 1},
+		{"not found fails at once", http.StatusNotFound, 1},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var requests int64
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				atomic.AddInt64(&requests, 1)
+				w.WriteHeader(test.status)
+			}))
+			defer server.Close()
+
+			pool := NewTokenPool("test", staticTokens([]string{"token"}), 6000)
+			_, err := doSearchRequest(context.Background(), pool, func(token string) (*http.Request, error) {
+				return http.NewRequest("GET", server.URL, nil)
+			})
+			if err == nil {
+				t.Fatal("request succeeded")
+			}
+
+			if requests != test.requests {
+				t.Errorf("%d requests, expected %d", requests, test.requests)
+			}
+		})
+	}
+
+	// the wait before the retry of the server error ends with the run
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer server.Close()
+
+	pool := NewTokenPool("test", staticTokens([]string{"token"}), 6000)
+	started := time.Now()
+	_, err := doSearchRequest(ctx, pool, func(token string) (*http.Request, error) {
+		return http.NewRequest("GET", server.URL, nil)
+	})
+	if err != context.DeadlineExceeded || time.Since(started) > 5*time.Second {
+		t.Errorf("canceled request: %v after %s, expected %v", err, time.Since(started), context.DeadlineExceeded)
+	}
+}
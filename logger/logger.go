@@ -0,0 +1,57 @@
+package logger
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"../config"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Log formats (log.format in Config.json)
+const (
+	FormatJSON   = "json"
+	FormatLogfmt = "logfmt"
+)
+
+// Log : logger shared by all packages, entries are annotated with fields (stage, report_id, keyword, token)
+var Log = logrus.New()
+
+// Init : configures format and level from config, defaults are logfmt and info
+func Init() (err error) {
+	setting := config.Settings.Log
+	Log.SetOutput(os.Stdout)
+
+	switch strings.ToLower(setting.Format) {
+	case FormatJSON:
+		Log.SetFormatter(&logrus.JSONFormatter{})
+	case FormatLogfmt, "":
+		Log.SetFormatter(&logrus.TextFormatter{DisableColors: true, FullTimestamp: true})
+	default:
+		return fmt.Errorf("logger: unknown format %q", setting.Format)
+	}
+
+	if setting.Level == "" {
+		Log.SetLevel(logrus.InfoLevel)
+		return
+	}
+	return SetLevel(setting.Level)
+}
+
+// SetLevel : changes the level at runtime
+func SetLevel(level string) (err error) {
+	parsed, err := logrus.ParseLevel(level)
+	if err != nil {
+		return
+	}
+
+	Log.SetLevel(parsed)
+	return
+}
+
+// Level : current level
+func Level() string {
+	return Log.GetLevel().String()
+}
@@ -2,128 +2,77 @@ package main
 
 import (
 	"context"
-	"fmt"
-	"runtime"
+	"os"
+	"os/signal"
 	"sync"
-	"time"
+	"syscall"
 
+	"./auth"
 	"./backend"
 	"./config"
 	"./database"
 	"./gitsearch"
+	"./logger"
 )
 
-func pError(err error) (message string) {
-	errMessage := err.Error()
-	_, file, line, _ := runtime.Caller(1)
-
-	message = fmt.Sprintf("[ERROR] %s %d :\n%s\n\n", file, line, errMessage)
-	return
-}
-
 func main() {
 	config.StartInit()
-	db := database.Connect()
+	err := logger.Init()
+	if err != nil {
+		logger.Log.WithError(err).Fatal("invalid log settings")
+	}
 
-	defer database.DB.Close()
+	ctx, cancel := context.WithCancel(context.Background())
 
-	ctx := context.Background()
-	errchan := make(chan string, 256)
+	// SIGINT/SIGTERM cancel the context, the server and the scheduler are stopped
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		logger.Log.WithField("signal", sig.String()).Info("shutting down")
+		cancel()
+	}()
 
-	searchStart := make(chan struct{}, 1)
-	extractStart := make(chan struct{}, 1)
-	searchDone := make(chan struct{}, 1)
-	extractDone := make(chan struct{}, 1)
+	db, err := database.Connect(ctx)
+	if err != nil {
+		logger.Log.WithError(err).Fatal("can not connect to database")
+	}
 
-	var wg sync.WaitGroup
+	defer database.DB.Close()
 
-	wg.Add(1)
-	// start logger
-	go func(ctx context.Context, errchan chan string, wg *sync.WaitGroup) {
-		defer wg.Done()
-		var err string
+	version, err := database.Migrate(db)
+	if err != nil {
+		logger.Log.WithError(err).Fatal("can not migrate database schema")
+	}
 
-		for {
-			select {
-			case err = <-errchan:
-				fmt.Printf("%s", err)
+	// "migrate" subcommand only applies migrations
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		logger.Log.WithField("version", version).Info("database schema is up to date")
+		return
+	}
 
-			case <-ctx.Done():
-				return
+	// the first admin is created from admin_credentials
+	err = auth.EnsureAdmin()
+	if err != nil {
+		logger.Log.WithError(err).Error("can not create admin")
+	}
 
-			default:
-			}
-		}
-	}(ctx, errchan, &wg)
+	// interrupted work of the previous process is rolled back, so the pipeline resumes from consistent state
+	err = gitsearch.RecoverInterruptedWork()
+	if err != nil {
+		logger.Log.WithError(err).Error("can not recover interrupted work")
+	}
 
+	var wg sync.WaitGroup
 	wg.Add(1)
-	// git search & fetch
-	go func(ctx context.Context, chanstart chan struct{}, chandone chan struct{}, errchan chan string, wg *sync.WaitGroup) {
-		defer wg.Done()
-		var err error
-
-		for {
-			select {
-			case <-chanstart:
-				{
-					err = gitsearch.GitSearch(ctx, errchan)
-					if err != nil {
-						errchan <- pError(err)
-					}
-					err = gitsearch.GitFetch(ctx, errchan)
-					if err != nil {
-						errchan <- pError(err)
-					}
-					chandone <- struct{}{}
-				}
-
-			case <-ctx.Done():
-				{
-					return
-				}
-			default:
-				<-time.After(5 * time.Second)
-
-			}
-		}
-	}(ctx, searchStart, searchDone, errchan, &wg)
-
-	// text fragment extraxtion
-	go func(ctx context.Context, chanstart chan struct{}, chandone chan struct{}, errchan chan string, wg *sync.WaitGroup) {
-		defer wg.Done()
-		var err error
-
-		for {
-			select {
-			case <-chanstart:
-				{
-					err = gitsearch.GitExtractFragments(ctx, 2, errchan)
-					if err != nil {
-						errchan <- pError(err)
-					}
-				}
-			case <-ctx.Done():
-				{
-					return
-				}
-			default:
-				<-time.After(5 * time.Second)
-			}
-		}
-	}(ctx, extractStart, extractDone, errchan, &wg)
-
-	//searchStart <- struct{}{}
-
+	// search → fetch → extract on schedule
 	go func() {
-		select {
-		case <-searchDone:
-			{
-				extractStart <- struct{}{}
-			}
-		}
-		return
+		defer wg.Done()
+		gitsearch.RunScheduler(ctx)
 	}()
-	searchDone <- struct{}{}
 
-	backend.StartBack(db)
+	backend.StartBack(ctx, db)
+
+	cancel()
+	wg.Wait()
 }
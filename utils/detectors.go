@@ -0,0 +1,151 @@
+package textutils
+
+import (
+	"math"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// Detector : named secret pattern, Confidence is a probability that the match is a real secret
+type Detector struct {
+	Name       string
+	Confidence float32
+	Rule       *regexp.Regexp
+	// Group : submatch that contains the secret itself (0: whole match)
+	Group int
+	// Validate : additional check of the secret (optional)
+	Validate func(secret string) bool
+}
+
+// DetectorHit : secret found by the detector, offsets are relative to the fragment after FragmentHits
+type DetectorHit struct {
+	Name       string  `json:"name"`
+	Confidence float32 `json:"confidence"`
+	Left       int     `json:"left"`
+	Right      int     `json:"right"`
+}
+
+// minimal entropy (bits per char) of the generic secret
+const highEntropyThreshold = 4.0
+
+var placeholderPasswords = []string{"password", "passwd", "changeme", "secret", "example", "xxx", "***", "<", "${", "{{", "%s"}
+
+// Detectors : built-in detectors
+var Detectors = []Detector{
+	{Name: "aws_access_key", Confidence: 0.9, Rule: regexp.MustCompile(`\b((?:AKIA|ASIA|AGPA|AIDA|AROA|ANPA|ANVA)[0-9A-Z]{16})\b`), Group: 1},
+	{Name: "aws_secret_key", Confidence: 0.8, Rule: regexp.MustCompile(`(?i)aws.{0,20}secret.{0,20}?['"]?\s*[=:]\s*['"]?([0-9a-zA-Z/+]{40})(?:[^0-9a-zA-Z/+]|$)`), Group: 1},
+	{Name: "gcp_api_key", Confidence: 0.85, Rule: regexp.MustCompile(`\bAIza[0-9A-Za-z\-_]{35}\b`)},
+	{Name: "gcp_service_account", Confidence: 0.9, Rule: regexp.MustCompile(`"type"\s*:\s*"service_account"`)},
+	{Name: "azure_storage_key", Confidence: 0.9, Rule: regexp.MustCompile(`AccountKey=([A-Za-z0-9+/]{86}==)`), Group: 1},
+	{Name: "azure_client_secret", Confidence: 0.6, Rule: regexp.MustCompile(`(?i)(?:client_?secret|azure_?secret)['"]?\s*[=:]\s*['"]([A-Za-z0-9_~.\-]{34,40})['"]`), Group: 1},
+	{Name: "private_key", Confidence: 0.95, Rule: regexp.MustCompile(`-----BEGIN (?:RSA |EC |DSA |OPENSSH |ENCRYPTED |PGP )?PRIVATE KEY(?: BLOCK)?-----`)},
+	{Name: "jwt", Confidence: 0.6, Rule: regexp.MustCompile(`\beyJ[A-Za-z0-9_-]{10,}\.eyJ[A-Za-z0-9_-]{10,}\.[A-Za-z0-9_-]{10,}`)},
+	{Name: "slack_token", Confidence: 0.9, Rule: regexp.MustCompile(`\bxox[abposr]-[0-9A-Za-z-]{10,}`)},
+	{Name: "slack_webhook", Confidence: 0.9, Rule: regexp.MustCompile(`https://hooks\.slack\.com/services/T[A-Z0-9]+/B[A-Z0-9]+/[A-Za-z0-9]+`)},
+	{Name: "github_token", Confidence: 0.95, Rule: regexp.MustCompile(`\b(?:gh[pousr]_[A-Za-z0-9]{36}|github_pat_[A-Za-z0-9_]{82})\b`)},
+	{
+		Name:       "connection_string",
+		Confidence: 0.7,
+		Rule:       regexp.MustCompile(`\b[a-zA-Z][a-zA-Z0-9+.\-]{1,20}://[^:/\s'"@]+:([^@/\s'"]+)@[^/\s'"]+`),
+		Group:      1,
+		Validate:   isRealPassword,
+	},
+	{
+		Name:       "high_entropy_string",
+		Confidence: 0.4,
+		Rule:       regexp.MustCompile(`(?i)(?:key|token|secret|passw(?:or)?d|pwd|auth|credential)[a-z_\-]*['"]?\s*[=:]\s*['"]([A-Za-z0-9+/=_\-]{20,})['"]`),
+		Group:      1,
+		Validate:   isHighEntropy,
+	},
+}
+
+// ShannonEntropy : bits per char
+func ShannonEntropy(s string) float64 {
+	if s == "" {
+		return 0
+	}
+
+	counts := make(map[rune]int)
+	n := 0
+	for _, r := range s {
+		counts[r]++
+		n++
+	}
+
+	entropy := 0.0
+	for _, count := range counts {
+		p := float64(count) / float64(n)
+		entropy -= p * math.Log2(p)
+	}
+	return entropy
+}
+
+func isHighEntropy(secret string) bool {
+	return ShannonEntropy(secret) >= highEntropyThreshold
+}
+
+func isRealPassword(secret string) bool {
+	lower := strings.ToLower(secret)
+	for _, placeholder := range placeholderPasswords {
+		if strings.Contains(lower, placeholder) {
+			return false
+		}
+	}
+	return true
+}
+
+// Detect : all hits of detectors in the text, offsets are in bytes
+func Detect(text string, detectors []Detector) (hits []DetectorHit) {
+	for _, detector := range detectors {
+		for _, match := range detector.Rule.FindAllStringSubmatchIndex(text, -1) {
+			left, right := match[2*detector.Group], match[2*detector.Group+1]
+			if left < 0 {
+				continue
+			}
+
+			if detector.Validate != nil && !detector.Validate(text[left:right]) {
+				continue
+			}
+
+			hits = append(hits, DetectorHit{Name: detector.Name, Confidence: detector.Confidence, Left: left, Right: right})
+		}
+	}
+	return
+}
+
+// FragmentHits : hits inside the fragment, with offsets relative to the fragment
+func FragmentHits(fragment Fragment, hits []DetectorHit) (fragmentHits []DetectorHit) {
+	fragmentHits = make([]DetectorHit, 0, len(hits))
+	for _, hit := range hits {
+		if hit.Left >= fragment.Left && hit.Right <= fragment.Right {
+			hit.Left -= fragment.Left
+			hit.Right -= fragment.Left
+			fragmentHits = append(fragmentHits, hit)
+		}
+	}
+	return
+}
+
+// ConvertHitsToRunes : converts hit offsets from bytes to runes
+func ConvertHitsToRunes(text string, hits []DetectorHit) []DetectorHit {
+	for i := range hits {
+		if hits[i].Right > len(text) || hits[i].Left > hits[i].Right {
+			continue
+		}
+		left, right := hits[i].Left, hits[i].Right
+		hits[i].Left = utf8.RuneCountInString(text[:left])
+		hits[i].Right = hits[i].Left + utf8.RuneCountInString(text[left:right])
+	}
+	return hits
+}
+
+// MaxConfidence : confidence of the most reliable hit
+func MaxConfidence(hits []DetectorHit) (confidence float32) {
+	for _, hit := range hits {
+		if hit.Confidence > confidence {
+			confidence = hit.Confidence
+		}
+	}
+	return
+}
@@ -5,6 +5,7 @@ import (
 	"io"
 	"os"
 	"regexp"
+	"sort"
 	"strings"
 	"unicode/utf8"
 )
@@ -18,6 +19,10 @@ type Fragment struct {
 	Left           int
 	Right          int
 	KeywordIndices []int
+	Hits           []DetectorHit
+	// InternalIndices : matches of internal keywords, they are highlighted, but do not produce fragments
+	InternalIndices []int
+	Priority        int
 }
 
 func (f *Fragment) Length() int {
@@ -111,7 +116,7 @@ func getKeywordContext(text, keyword string, maxFragLen, desiredLines int) (frag
 			}
 		}
 
-		fragment := Fragment{lBorder, rBorder, []int{ind, ind + len(keyword)}}
+		fragment := Fragment{Left: lBorder, Right: rBorder, KeywordIndices: []int{ind, ind + len(keyword)}}
 		fragments = append(fragments, fragment)
 	}
 	return fragments, err
@@ -285,6 +290,61 @@ func GenTextFragments(text string, keywords []string, maxFragmentLen, maxUnionLe
 	return fragments, err
 }
 
+func overlaps(left, right int, indices []int) bool {
+	for i := 0; i+1 < len(indices); i += 2 {
+		if left < indices[i+1] && indices[i] < right {
+			return true
+		}
+	}
+	return false
+}
+
+// AnnotateFragment : marks internal keywords inside the fragment, priority is the number of distinct internal keywords found.
+// Matches, that overlap search keywords, are skipped, so highlighted ranges never intersect.
+func AnnotateFragment(text string, fragment *Fragment, keywords []string) {
+	fragmentText := text[fragment.Left:fragment.Right]
+	pairs := make([][2]int, 0, 8)
+	fragment.Priority = 0
+
+	for _, keyword := range keywords {
+		if keyword == "" {
+			continue
+		}
+
+		found := false
+		for _, ind := range getKeywordIndices(fragmentText, keyword) {
+			left := fragment.Left + ind
+			right := left + len(keyword)
+			if overlaps(left, right, fragment.KeywordIndices) {
+				continue
+			}
+
+			overlapped := false
+			for _, pair := range pairs {
+				if left < pair[1] && pair[0] < right {
+					overlapped = true
+					break
+				}
+			}
+
+			if !overlapped {
+				pairs = append(pairs, [2]int{left, right})
+				found = true
+			}
+		}
+
+		if found {
+			fragment.Priority++
+		}
+	}
+
+	sort.Slice(pairs, func(i, j int) bool { return pairs[i][0] < pairs[j][0] })
+	fragment.InternalIndices = make([]int, 0, 2*len(pairs))
+	for _, pair := range pairs {
+		fragment.InternalIndices = append(fragment.InternalIndices, pair[0], pair[1])
+	}
+}
+
 // CheckFragment : reject fragments than match rejection rules
 func CheckFragment(text string, fragment Fragment, rules []RejectRule) (matchId int) {
 	textFragment := []byte(text[fragment.Left:fragment.Right])